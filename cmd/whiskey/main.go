@@ -2,43 +2,44 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 
-	"runtime"
-
 	"os"
 
 	"github.com/namsral/flag"
 	"github.com/noonat/whiskey/prefork"
-	"github.com/noonat/whiskey/wsgi"
 )
 
 func main() {
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 
-	var (
-		addr       string
-		workers    int
-		wsgiConns  int
-		wsgiModule string
-	)
-	flag.StringVar(&addr, "addr", ":8080", "Listen for HTTP connections on this address")
-	flag.IntVar(&workers, "workers", runtime.NumCPU(), "Number of worker processes.")
-	flag.StringVar(&wsgiModule, "wsgi-module", "", "Module and function to run for the WSGI application. (e.g. my_wsgi_app:application)")
-	flag.IntVar(&wsgiConns, "wsgi-conns", 1000, "Number of simultaneous connections per worker.")
-	flag.Parse()
-	if wsgiModule == "" {
-		fmt.Fprintln(os.Stderr, "error: -wsgi-module is required")
-		flag.Usage()
-		os.Exit(1)
+	s, err := parseSettings(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
 	}
 
 	go http.ListenAndServe(":8181", http.DefaultServeMux)
 
-	w := &wsgi.Worker{Module: wsgiModule, NumConns: wsgiConns}
-	if err := prefork.Run(w, addr, workers, logger); err != nil {
+	cfg := s.preforkConfig()
+	cfg.Reload = func(cfg *prefork.Config) error {
+		// New workers read the settings for themselves when they start, so
+		// only the manager's settings need to be updated here.
+		s, err := parseSettings(os.Args[1:], ioutil.Discard)
+		if err != nil {
+			return err
+		}
+		reload := cfg.Reload
+		*cfg = s.preforkConfig()
+		cfg.Reload = reload
+		return nil
+	}
+	if err := prefork.Run(s.worker(), cfg, logger); err != nil {
 		log.Fatalf("%+v\n", err)
 	}
 }
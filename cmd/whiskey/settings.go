@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/namsral/flag"
+	"github.com/noonat/whiskey/prefork"
+	"github.com/noonat/whiskey/wsgi"
+	"github.com/pkg/errors"
+)
+
+// envPrefix is prepended to the names of the environment variables for each
+// setting, so -wsgi-module can be set with WHISKEY_WSGI_MODULE.
+const envPrefix = "WHISKEY"
+
+func init() {
+	// Config files are loaded by parseSettings instead of the flag package,
+	// so that they can be Python files.
+	flag.DefaultConfigFlagname = ""
+}
+
+// settings are Whiskey's settings. Each one can be set by a command line
+// flag, an environment variable, or a config file. They're documented in the
+// Settings section of the README.
+type settings struct {
+	accessLog   string
+	accessFmt   string
+	addr        string
+	binds       stringsValue
+	caCerts     string
+	certFile    string
+	clientCert  string
+	config      string
+	debug       bool
+	graceful    time.Duration
+	hardHeap    int64
+	hardMemory  bytesValue
+	honorStart  bool
+	keyFile     string
+	maxRequests int
+	maxJitter   int
+	maxQueue    int
+	maxQueueFor time.Duration
+	minThreads  int
+	metricsAddr string
+	pathTimeout pathTimeoutsValue
+	reloadPlace bool
+	reqTimeout  time.Duration
+	scriptName  string
+	socketMode  fileModeValue
+	softHeap    int64
+	softMemory  bytesValue
+	socketOwner string
+	statusAddr  string
+	statsEvery  time.Duration
+	threadIdle  time.Duration
+	threads     int
+	timeout     time.Duration
+	workers     int
+	wsgiConns   int
+	wsgiModule  string
+}
+
+// parseSettings parses the settings from the command line arguments, the
+// environment, and the config file, if one is given. Flags take precedence
+// over environment variables, which take precedence over the config file.
+// The application can be given as the only positional argument, instead of
+// with -wsgi-module. Errors and usage messages are written to output.
+func parseSettings(args []string, output io.Writer) (*settings, error) {
+	s := &settings{}
+	fs := flag.NewFlagSetWithEnvPrefix("whiskey", envPrefix, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(output, "Usage: whiskey [flags] [module:application]")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&s.config, "config", "", "Load settings from this file. Files ending in .py are run as Python, otherwise they contain one \"name value\" pair per line.")
+	fs.Var(&s.binds, "bind", "Listen for HTTP connections on this address, or on a Unix socket given as unix:/path. Can be given more than once, or as a comma separated list. (default :8080)")
+	fs.StringVar(&s.addr, "addr", "", "Listen for HTTP connections on this address, if -bind isn't given.")
+	fs.Var(&s.socketMode, "socket-mode", "File mode for Unix sockets, in octal. (e.g. 660)")
+	fs.StringVar(&s.socketOwner, "socket-owner", "", "Owner for Unix sockets, as user, user:group, or :group.")
+	fs.StringVar(&s.certFile, "certfile", "", "Serve HTTPS using this TLS certificate file.")
+	fs.StringVar(&s.keyFile, "keyfile", "", "TLS key file, if the key isn't in -certfile.")
+	fs.StringVar(&s.caCerts, "ca-certs", "", "CA certificates file used to verify client certificates.")
+	fs.StringVar(&s.clientCert, "client-cert", wsgi.ClientCertNone, "Whether to ask clients for a TLS certificate: none, optional, or required.")
+	fs.IntVar(&s.workers, "workers", runtime.NumCPU(), "Number of worker processes.")
+	fs.DurationVar(&s.timeout, "timeout", 30*time.Second, "Kill workers that haven't sent a heartbeat in this long. (0 to disable)")
+	fs.DurationVar(&s.graceful, "graceful-timeout", 30*time.Second, "Wait this long for requests to finish when stopping workers gracefully. (0 to wait forever)")
+	fs.DurationVar(&s.reqTimeout, "request-timeout", 0, "Interrupt requests that run for longer than this, and respond with a 504. (0 to disable)")
+	fs.Var(&s.pathTimeout, "path-timeout", "Use a different -request-timeout for URL paths starting with a prefix, given as prefix=duration. Can be given more than once, or as a comma separated list. (e.g. /reports=5m)")
+	fs.BoolVar(&s.reloadPlace, "reload-in-place", false, "Make HUP reload the workers in place, e.g. to renew TLS certificates, instead of replacing them.")
+	fs.IntVar(&s.maxRequests, "max-requests", 0, "Replace each worker after it's served this many requests. (0 to disable)")
+	fs.IntVar(&s.maxJitter, "max-requests-jitter", 0, "Add a random number of requests, up to this many, to -max-requests for each worker.")
+	fs.Var(&s.softMemory, "soft-memory-limit", "Replace workers using more than this much resident memory, in bytes or with a K, M, or G suffix. (e.g. 512M)")
+	fs.Var(&s.hardMemory, "hard-memory-limit", "Kill workers using more than this much resident memory.")
+	fs.Int64Var(&s.softHeap, "soft-heap-limit", 0, "Replace workers with more than this many blocks allocated by Python. (0 to disable)")
+	fs.Int64Var(&s.hardHeap, "hard-heap-limit", 0, "Kill workers with more than this many blocks allocated by Python. (0 to disable)")
+	fs.StringVar(&s.wsgiModule, "wsgi-module", "", "Module and function to run for the WSGI application, if it isn't given as an argument. (e.g. my_wsgi_app:application)")
+	fs.IntVar(&s.wsgiConns, "wsgi-conns", 1000, "Number of simultaneous connections per worker, including idle keep-alive connections.")
+	fs.IntVar(&s.threads, "threads", 0, "Number of requests each worker runs in Python at once. (0 for the same as -wsgi-conns)")
+	fs.IntVar(&s.minThreads, "min-threads", 1, "Number of idle Python thread states each worker keeps.")
+	fs.DurationVar(&s.threadIdle, "thread-idle-timeout", time.Minute, "Free Python thread states that have been idle for this long, down to -min-threads. (0 to keep them forever)")
+	fs.IntVar(&s.maxQueue, "max-queue", 0, "Respond with a 503 if this many requests are already waiting for a free connection in a worker. (0 for no limit)")
+	fs.DurationVar(&s.maxQueueFor, "max-queue-time", 0, "Respond with a 503 if a request waits this long for a free connection in a worker. (0 for no limit)")
+	fs.BoolVar(&s.honorStart, "honor-request-start", false, "Count the time since the load balancer's X-Request-Start header towards -max-queue-time.")
+	fs.BoolVar(&s.debug, "debug", false, "Include Python tracebacks in error responses. Don't use this in production.")
+	fs.StringVar(&s.statusAddr, "status-addr", "", "Serve the manager's status and worker stats as JSON on this address. (empty to disable)")
+	fs.StringVar(&s.metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address. (empty to disable)")
+	fs.DurationVar(&s.statsEvery, "stats-interval", 0, "Log the worker stats this often. (0 to disable)")
+	fs.StringVar(&s.scriptName, "script-name", "", "URL prefix the application is mounted at, passed as SCRIPT_NAME.")
+	fs.StringVar(&s.accessLog, "access-log", "", "Write an access log line for each request to this file, \"-\" for stdout, or \"syslog\". (empty to disable)")
+	fs.StringVar(&s.accessFmt, "access-log-format", "combined", "Access log format: common, combined, json, or a gunicorn-style format string.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if s.config != "" {
+		if err := loadConfigFile(fs, s.config); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.binds) == 0 {
+		if s.addr != "" {
+			s.binds = stringsValue{s.addr}
+		} else {
+			s.binds = stringsValue{":8080"}
+		}
+	}
+	if err := s.checkTLS(); err != nil {
+		return nil, err
+	}
+	if err := s.checkThreads(); err != nil {
+		return nil, err
+	}
+	switch fs.NArg() {
+	case 0:
+		if s.wsgiModule == "" {
+			return nil, errors.New("an application is required (e.g. whiskey hello:application)")
+		}
+	case 1:
+		s.wsgiModule = fs.Arg(0)
+	default:
+		return nil, errors.Errorf("expected one application, got %d arguments", fs.NArg())
+	}
+	return s, nil
+}
+
+// checkTLS returns an error if the TLS settings don't make sense together.
+// Whether the files can be loaded is checked when the workers start.
+func (s *settings) checkTLS() error {
+	switch s.clientCert {
+	case wsgi.ClientCertNone, wsgi.ClientCertOptional, wsgi.ClientCertRequired:
+	default:
+		return errors.Errorf("invalid value %q for -client-cert", s.clientCert)
+	}
+	if s.certFile == "" {
+		if s.keyFile != "" || s.caCerts != "" || s.clientCert != wsgi.ClientCertNone {
+			return errors.New("-certfile is required to use TLS")
+		}
+	} else if s.clientCert != wsgi.ClientCertNone && s.caCerts == "" {
+		return errors.New("-ca-certs is required to verify client certificates")
+	}
+	return nil
+}
+
+// checkThreads returns an error if the connection and thread settings don't
+// make sense together.
+func (s *settings) checkThreads() error {
+	if s.wsgiConns < 1 {
+		return errors.Errorf("-wsgi-conns must be at least 1, got %d", s.wsgiConns)
+	} else if s.threads < 0 {
+		return errors.Errorf("-threads can't be negative, got %d", s.threads)
+	} else if s.minThreads < 0 {
+		return errors.Errorf("-min-threads can't be negative, got %d", s.minThreads)
+	}
+	threads := s.threads
+	if threads == 0 {
+		threads = s.wsgiConns
+	}
+	if s.minThreads > threads {
+		return errors.Errorf("-min-threads can't be more than the %d threads each worker has", threads)
+	}
+	return nil
+}
+
+// loadConfigFile sets any flags that haven't been set yet from the config
+// file at path.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	if filepath.Ext(path) != ".py" {
+		return errors.Wrapf(fs.ParseFile(path), "error reading config file %s", path)
+	}
+
+	cs, err := wsgi.ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, c := range cs {
+		if set[c.Name] {
+			continue
+		}
+		f := fs.Lookup(c.Name)
+		if f == nil || f.Name == "config" {
+			return errors.Errorf("%s: unknown setting %s", path, c.Name)
+		}
+		value := c.Value
+		if g, ok := f.Value.(flag.Getter); ok {
+			// Durations can be given as a number of seconds, like gunicorn.
+			if _, ok := g.Get().(time.Duration); ok {
+				if n, err := strconv.ParseFloat(value, 64); err == nil {
+					value = fmt.Sprintf("%gs", n)
+				}
+			}
+		}
+		if err := fs.Set(c.Name, value); err != nil {
+			return errors.Wrapf(err, "%s: invalid value %q for %s", path, c.Value, c.Name)
+		}
+	}
+	return nil
+}
+
+// preforkConfig returns the config for the prefork package.
+func (s *settings) preforkConfig() prefork.Config {
+	return prefork.Config{
+		Addrs:           s.binds,
+		SocketMode:      os.FileMode(s.socketMode),
+		SocketOwner:     s.socketOwner,
+		NumWorkers:      s.workers,
+		Timeout:         s.timeout,
+		GracefulTimeout: s.graceful,
+		StatusAddr:      s.statusAddr,
+		MetricsAddr:     s.metricsAddr,
+		StatsInterval:   s.statsEvery,
+		SoftMemoryLimit: int64(s.softMemory),
+		HardMemoryLimit: int64(s.hardMemory),
+		SoftHeapLimit:   s.softHeap,
+		HardHeapLimit:   s.hardHeap,
+		ReloadInPlace:   s.reloadPlace,
+	}
+}
+
+// worker returns the WSGI worker.
+func (s *settings) worker() *wsgi.Worker {
+	return &wsgi.Worker{
+		Module:            s.wsgiModule,
+		NumConns:          s.wsgiConns,
+		NumThreads:        s.threads,
+		MinThreads:        s.minThreads,
+		ThreadIdleTimeout: s.threadIdle,
+		ScriptName:        s.scriptName,
+		Debug:             s.debug,
+		AccessLog:         s.accessLog,
+		AccessLogFormat:   s.accessFmt,
+		CertFile:          s.certFile,
+		KeyFile:           s.keyFile,
+		CACerts:           s.caCerts,
+		ClientCert:        s.clientCert,
+		MaxRequests:       s.maxRequests,
+		MaxRequestsJitter: s.maxJitter,
+		RequestTimeout:    s.reqTimeout,
+		PathTimeouts:      s.pathTimeout,
+		MaxQueue:          s.maxQueue,
+		MaxQueueTime:      s.maxQueueFor,
+		HonorRequestStart: s.honorStart,
+	}
+}
+
+// stringsValue is a flag that can be given more than once, or as a comma
+// separated list.
+type stringsValue []string
+
+func (v *stringsValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *stringsValue) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*v = append(*v, part)
+		}
+	}
+	return nil
+}
+
+func (v *stringsValue) Get() interface{} {
+	return []string(*v)
+}
+
+// pathTimeoutsValue is a flag for timeouts for URL path prefixes, given as
+// prefix=duration. It can be given more than once, or as a comma separated
+// list.
+type pathTimeoutsValue map[string]time.Duration
+
+func (v *pathTimeoutsValue) String() string {
+	var parts []string
+	for prefix, d := range *v {
+		parts = append(parts, prefix+"="+d.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (v *pathTimeoutsValue) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, "=")
+		if i <= 0 || !strings.HasPrefix(part, "/") {
+			return errors.Errorf("invalid path timeout %q, expected /prefix=duration", part)
+		}
+		d, err := time.ParseDuration(part[i+1:])
+		if err != nil || d < 0 {
+			return errors.Errorf("invalid duration in path timeout %q", part)
+		}
+		if *v == nil {
+			*v = pathTimeoutsValue{}
+		}
+		(*v)[part[:i]] = d
+	}
+	return nil
+}
+
+func (v *pathTimeoutsValue) Get() interface{} {
+	return map[string]time.Duration(*v)
+}
+
+// fileModeValue is a flag for a file mode, given in octal.
+type fileModeValue os.FileMode
+
+func (v *fileModeValue) String() string {
+	if *v == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*v), 8)
+}
+
+func (v *fileModeValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return errors.Errorf("invalid file mode %q", s)
+	}
+	*v = fileModeValue(n)
+	return nil
+}
+
+func (v *fileModeValue) Get() interface{} {
+	return os.FileMode(*v)
+}
+
+// bytesValue is a flag for a number of bytes, with an optional K, M, or G
+// suffix for kibibytes, mebibytes, or gibibytes.
+type bytesValue int64
+
+func (v *bytesValue) String() string {
+	if *v == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func (v *bytesValue) Set(s string) error {
+	n, unit := strings.TrimSpace(s), int64(1)
+	if i := len(n) - 1; i > 0 {
+		switch strings.ToUpper(n[i:]) {
+		case "K":
+			unit = 1 << 10
+		case "M":
+			unit = 1 << 20
+		case "G":
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			n = n[:i]
+		}
+	}
+	i, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || i < 0 {
+		return errors.Errorf("invalid size %q", s)
+	}
+	*v = bytesValue(i * unit)
+	return nil
+}
+
+func (v *bytesValue) Get() interface{} {
+	return int64(*v)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/noonat/whiskey/wsgi"
+)
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseSettingsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whiskey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfigFile(t, dir, "whiskey.conf", `# comment
+workers 3
+timeout=5s
+wsgi-module file:application
+script-name /file
+`)
+
+	os.Setenv("WHISKEY_WORKERS", "4")
+	os.Setenv("WHISKEY_TIMEOUT", "6s")
+	defer os.Unsetenv("WHISKEY_WORKERS")
+	defer os.Unsetenv("WHISKEY_TIMEOUT")
+
+	s, err := parseSettings([]string{"-config", path, "-workers", "5"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.workers != 5 {
+		t.Errorf("expected the flag to set workers to 5, got %d", s.workers)
+	}
+	if s.timeout != 6*time.Second {
+		t.Errorf("expected the environment to set timeout to 6s, got %s", s.timeout)
+	}
+	if s.wsgiModule != "file:application" || s.scriptName != "/file" {
+		t.Errorf("expected the file to set wsgi-module and script-name, got %q and %q", s.wsgiModule, s.scriptName)
+	}
+	if s.graceful != 30*time.Second {
+		t.Errorf("expected graceful-timeout to default to 30s, got %s", s.graceful)
+	}
+}
+
+func TestParseSettingsPythonConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whiskey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfigFile(t, dir, "whiskey.conf.py", `import os
+
+_base = 2
+workers = _base * 2
+graceful_timeout = 1.5
+timeout = '10s'
+debug = True
+wsgi_module = 'hello:application'
+access_log = None
+
+
+def helper():
+    pass
+`)
+
+	s, err := parseSettings([]string{"-config", path, "-wsgi-conns", "7"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.workers != 4 || !s.debug || s.wsgiModule != "hello:application" || s.accessLog != "" {
+		t.Errorf("unexpected settings %+v", s)
+	}
+	if s.graceful != 1500*time.Millisecond || s.timeout != 10*time.Second {
+		t.Errorf("expected durations of 1.5s and 10s, got %s and %s", s.graceful, s.timeout)
+	}
+	if s.wsgiConns != 7 {
+		t.Errorf("expected the flag to set wsgi-conns to 7, got %d", s.wsgiConns)
+	}
+
+	path = writeConfigFile(t, dir, "bad.conf.py", "wrokers = 4\n")
+	if _, err := parseSettings([]string{"-config", path}, ioutil.Discard); err == nil {
+		t.Error("expected error for unknown setting, got nil")
+	}
+	path = writeConfigFile(t, dir, "bad2.conf.py", "workers = 'many'\nwsgi_module = 'a:b'\n")
+	if _, err := parseSettings([]string{"-config", path}, ioutil.Discard); err == nil {
+		t.Error("expected error for invalid value, got nil")
+	}
+}
+
+func TestParseSettingsApplication(t *testing.T) {
+	os.Setenv("WHISKEY_WSGI_MODULE", "env:application")
+	s, err := parseSettings([]string{"-workers", "2", "hello:create_app()"}, ioutil.Discard)
+	os.Unsetenv("WHISKEY_WSGI_MODULE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.wsgiModule != "hello:create_app()" || s.workers != 2 {
+		t.Errorf("unexpected settings %+v", s)
+	}
+
+	for _, args := range [][]string{nil, {"a:b", "c:d"}} {
+		if _, err := parseSettings(args, ioutil.Discard); err == nil {
+			t.Errorf("%q: expected error, got nil", args)
+		}
+	}
+}
+
+func TestParseSettingsBinds(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected []string
+	}{
+		{nil, []string{":8080"}},
+		{[]string{"-addr", ":9000"}, []string{":9000"}},
+		{[]string{"-addr", ":9000", "-bind", ":9001"}, []string{":9001"}},
+		{[]string{"-bind", "127.0.0.1:80", "-bind", "[::1]:80,unix:/tmp/w.sock"}, []string{"127.0.0.1:80", "[::1]:80", "unix:/tmp/w.sock"}},
+	} {
+		s, err := parseSettings(append(tc.args, "hello:application"), ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg := s.preforkConfig(); !reflect.DeepEqual(cfg.Addrs, tc.expected) {
+			t.Errorf("%q: expected %q, got %q", tc.args, tc.expected, cfg.Addrs)
+		}
+	}
+
+	s, err := parseSettings([]string{"-socket-mode", "660", "-socket-owner", "www:www", "a:b"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := s.preforkConfig(); cfg.SocketMode != 0660 || cfg.SocketOwner != "www:www" {
+		t.Errorf("unexpected socket settings %o and %q", cfg.SocketMode, cfg.SocketOwner)
+	}
+	if _, err := parseSettings([]string{"-socket-mode", "rw", "a:b"}, ioutil.Discard); err == nil {
+		t.Error("expected error for invalid socket mode, got nil")
+	}
+}
+
+func TestParseSettingsTLS(t *testing.T) {
+	s, err := parseSettings([]string{"-certfile", "cert.pem", "-ca-certs", "ca.pem", "-client-cert", "required", "a:b"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := s.worker(); w.CertFile != "cert.pem" || w.CACerts != "ca.pem" || w.ClientCert != wsgi.ClientCertRequired {
+		t.Errorf("unexpected TLS settings %+v", w)
+	}
+
+	for _, args := range [][]string{
+		{"-keyfile", "key.pem"},
+		{"-certfile", "cert.pem", "-client-cert", "sometimes"},
+		{"-certfile", "cert.pem", "-client-cert", "optional"},
+	} {
+		if _, err := parseSettings(append(args, "a:b"), ioutil.Discard); err == nil {
+			t.Errorf("%q: expected error, got nil", args)
+		}
+	}
+}
+
+func TestParseSettingsMemoryLimits(t *testing.T) {
+	s, err := parseSettings([]string{"-soft-memory-limit", "512M", "-hard-memory-limit", "1g", "-soft-heap-limit", "1000", "a:b"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := s.preforkConfig()
+	if cfg.SoftMemoryLimit != 512<<20 || cfg.HardMemoryLimit != 1<<30 || cfg.SoftHeapLimit != 1000 || cfg.HardHeapLimit != 0 {
+		t.Errorf("unexpected limits %d, %d, %d, %d", cfg.SoftMemoryLimit, cfg.HardMemoryLimit, cfg.SoftHeapLimit, cfg.HardHeapLimit)
+	}
+	for _, size := range []string{"M", "12X", "-1K"} {
+		if _, err := parseSettings([]string{"-soft-memory-limit", size, "a:b"}, ioutil.Discard); err == nil {
+			t.Errorf("%q: expected error, got nil", size)
+		}
+	}
+}
+
+func TestParseSettingsTimeouts(t *testing.T) {
+	s, err := parseSettings([]string{"-request-timeout", "30s", "-path-timeout", "/reports=5m,/health=1s", "-path-timeout", "/a=b=2s", "a:b"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrk := s.worker()
+	expected := map[string]time.Duration{"/reports": 5 * time.Minute, "/health": time.Second, "/a=b": 2 * time.Second}
+	if wrk.RequestTimeout != 30*time.Second || !reflect.DeepEqual(wrk.PathTimeouts, expected) {
+		t.Errorf("unexpected timeouts %s, %v", wrk.RequestTimeout, wrk.PathTimeouts)
+	}
+	for _, value := range []string{"/reports", "reports=5m", "/reports=soon", "/reports=-1s"} {
+		if _, err := parseSettings([]string{"-path-timeout", value, "a:b"}, ioutil.Discard); err == nil {
+			t.Errorf("%q: expected error, got nil", value)
+		}
+	}
+}
+
+func TestParseSettingsQueue(t *testing.T) {
+	s, err := parseSettings([]string{"-max-queue", "50", "-max-queue-time", "2s", "-honor-request-start", "a:b"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrk := s.worker()
+	if wrk.MaxQueue != 50 || wrk.MaxQueueTime != 2*time.Second || !wrk.HonorRequestStart {
+		t.Errorf("unexpected queue settings %d, %s, %t", wrk.MaxQueue, wrk.MaxQueueTime, wrk.HonorRequestStart)
+	}
+}
+
+func TestParseSettingsThreads(t *testing.T) {
+	s, err := parseSettings([]string{"-wsgi-conns", "500", "-threads", "20", "-min-threads", "4", "-thread-idle-timeout", "30s", "a:b"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrk := s.worker()
+	if wrk.NumConns != 500 || wrk.NumThreads != 20 || wrk.MinThreads != 4 || wrk.ThreadIdleTimeout != 30*time.Second {
+		t.Errorf("unexpected thread settings %d, %d, %d, %s", wrk.NumConns, wrk.NumThreads, wrk.MinThreads, wrk.ThreadIdleTimeout)
+	}
+	for _, args := range [][]string{
+		{"-wsgi-conns", "0"},
+		{"-threads", "-1"},
+		{"-min-threads", "-1"},
+		{"-threads", "4", "-min-threads", "5"},
+		{"-wsgi-conns", "4", "-min-threads", "5"},
+	} {
+		if _, err := parseSettings(append(args, "a:b"), ioutil.Discard); err == nil {
+			t.Errorf("%q: expected error, got nil", args)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Package metrics provides a registry of counters, gauges and histograms.
+//
+// Snapshots of a registry can be encoded as JSON, which allows the prefork
+// manager to collect them from its workers and merge them together. The
+// merged snapshot can then be exported in the Prometheus text format.
+package metrics
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Kind is the type of a metric.
+type Kind string
+
+// These are the kinds of metrics supported by a registry.
+const (
+	KindCounter   Kind = "counter"
+	KindGauge     Kind = "gauge"
+	KindHistogram Kind = "histogram"
+)
+
+// DefaultBuckets are the histogram buckets used if none are specified. They're
+// the same as the Prometheus client's defaults, and are intended to measure
+// latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry used by Whiskey. Applications can add their own
+// metrics to it.
+var Default = NewRegistry()
+
+var (
+	nameRegexp      = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Registry holds a set of metrics. It's safe to use from multiple
+// goroutines.
+type Registry struct {
+	mutex      sync.Mutex
+	families   map[string]*family
+	collectors []func()
+}
+
+// family is a metric and all of its series, one per set of label values.
+type family struct {
+	name       string
+	help       string
+	kind       Kind
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+// series is the value of a metric for one set of label values. Counters and
+// gauges use value, and histograms use the rest. The bucket counts aren't
+// cumulative, and the last one is for the implicit +Inf bucket.
+type series struct {
+	labelValues  []string
+	value        float64
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// OnCollect adds a function that's called before each snapshot is taken. It
+// can be used to update metrics that mirror values from elsewhere.
+func (r *Registry) OnCollect(fn func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+// register adds a metric to the registry. Registering a metric that already
+// exists returns the existing one, as long as it has the same kind, labels,
+// and buckets.
+func (r *Registry) register(kind Kind, name, help string, buckets []float64, labelNames []string) (*family, error) {
+	if !nameRegexp.MatchString(name) {
+		return nil, errors.Errorf("invalid metric name %q", name)
+	}
+	for _, ln := range labelNames {
+		if !labelNameRegexp.MatchString(ln) || strings.HasPrefix(ln, "__") {
+			return nil, errors.Errorf("invalid label name %q for metric %s", ln, name)
+		} else if kind == KindHistogram && ln == "le" {
+			return nil, errors.Errorf("histogram %s can't have an le label", name)
+		}
+	}
+	if kind == KindHistogram {
+		if buckets == nil {
+			buckets = DefaultBuckets
+		}
+		if !sort.Float64sAreSorted(buckets) {
+			return nil, errors.Errorf("buckets for histogram %s aren't sorted", name)
+		}
+		for _, b := range buckets {
+			if math.IsNaN(b) || math.IsInf(b, 0) {
+				return nil, errors.Errorf("invalid bucket %v for histogram %s", b, name)
+			}
+		}
+	} else {
+		buckets = nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || !equalStrings(f.labelNames, labelNames) ||
+			!equalFloats(f.buckets, buckets) {
+			return nil, errors.Errorf("metric %s is already registered as a different %s", name, f.kind)
+		}
+		return f, nil
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: append([]string{}, labelNames...),
+		buckets:    append([]float64(nil), buckets...),
+		series:     map[string]*series{},
+	}
+	r.families[name] = f
+	return f, nil
+}
+
+// update calls fn with the series for the label values, creating it if
+// necessary. It holds the registry's lock while it does so.
+func (r *Registry) update(f *family, v float64, labelValues []string, fn func(s *series)) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return errors.Errorf("invalid value %v for metric %s", v, f.name)
+	}
+	if len(labelValues) != len(f.labelNames) {
+		return errors.Errorf("metric %s expects %d label values, got %d",
+			f.name, len(f.labelNames), len(labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if f.kind == KindHistogram {
+			s.bucketCounts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	fn(s)
+	return nil
+}
+
+// Lookup returns the metric registered with the name, as a *Counter, *Gauge
+// or *Histogram. It returns nil if there isn't one.
+func (r *Registry) Lookup(name string) interface{} {
+	r.mutex.Lock()
+	f, ok := r.families[name]
+	r.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	switch f.kind {
+	case KindCounter:
+		return &Counter{r, f}
+	case KindGauge:
+		return &Gauge{r, f}
+	case KindHistogram:
+		return &Histogram{r, f}
+	}
+	return nil
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+// NewCounter registers a counter. If labels are specified, each update must
+// pass a value for each of them, in the same order.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) (*Counter, error) {
+	f, err := r.register(KindCounter, name, help, nil, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{r, f}, nil
+}
+
+// Add adds v to the counter. v can't be negative.
+func (c *Counter) Add(v float64, labelValues ...string) error {
+	if v < 0 {
+		return errors.Errorf("counter %s can't be decreased", c.f.name)
+	}
+	return c.r.update(c.f, v, labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc(labelValues ...string) error {
+	return c.Add(1, labelValues...)
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+// NewGauge registers a gauge. If labels are specified, each update must pass
+// a value for each of them, in the same order.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) (*Gauge, error) {
+	f, err := r.register(KindGauge, name, help, nil, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{r, f}, nil
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) error {
+	return g.r.update(g.f, v, labelValues, func(s *series) {
+		s.value = v
+	})
+}
+
+// Add adds v to the gauge. v can be negative.
+func (g *Gauge) Add(v float64, labelValues ...string) error {
+	return g.r.update(g.f, v, labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// Histogram is a metric that counts observed values in buckets.
+type Histogram struct {
+	r *Registry
+	f *family
+}
+
+// NewHistogram registers a histogram. The buckets are the upper bounds of
+// each bucket, in increasing order, and DefaultBuckets are used if they're
+// nil. If labels are specified, each update must pass a value for each of
+// them, in the same order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) (*Histogram, error) {
+	f, err := r.register(KindHistogram, name, help, buckets, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	return &Histogram{r, f}, nil
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) error {
+	i := sort.SearchFloat64s(h.f.buckets, v)
+	return h.r.update(h.f, v, labelValues, func(s *series) {
+		s.bucketCounts[i]++
+		s.sum += v
+		s.count++
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	c1, err := r.NewCounter("requests_total", "Requests.", "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := r.NewCounter("requests_total", "Requests.", "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Inc("200")
+	c2.Inc("200")
+	if v := r.Snapshot()[0].Series[0].Value; v != 2 {
+		t.Errorf("expected registering twice to return the same counter, got %v", v)
+	}
+
+	for _, fn := range []func() error{
+		func() error { _, err := r.NewGauge("requests_total", "Requests."); return err },
+		func() error { _, err := r.NewCounter("requests_total", "Requests.", "method"); return err },
+		func() error { _, err := r.NewCounter("bad-name", "Bad."); return err },
+		func() error { _, err := r.NewCounter("bad_label", "Bad.", "bad-label"); return err },
+		func() error { _, err := r.NewHistogram("bad_le", "Bad.", nil, "le"); return err },
+		func() error { _, err := r.NewHistogram("bad_buckets", "Bad.", []float64{2, 1}); return err },
+	} {
+		if err := fn(); err == nil {
+			t.Error("expected error, got nil")
+		}
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	r := NewRegistry()
+	c, _ := r.NewCounter("c", "C.", "code")
+	g, _ := r.NewGauge("g", "G.")
+	if err := c.Inc(); err == nil {
+		t.Error("expected error for missing label values, got nil")
+	}
+	if err := c.Add(-1, "200"); err == nil {
+		t.Error("expected error for decreasing a counter, got nil")
+	}
+	if err := g.Set(math.NaN()); err == nil {
+		t.Error("expected error for NaN, got nil")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := NewRegistry()
+	c, _ := r.NewCounter("c", "C.", "code")
+	g, _ := r.NewGauge("g", "G.")
+	h, _ := r.NewHistogram("h", "H.", []float64{1, 2})
+	c.Inc("500")
+	c.Add(2, "200")
+	g.Set(5)
+	g.Add(-2)
+	h.Observe(0.5)
+	h.Observe(2)
+	h.Observe(3)
+	collected := 0
+	r.OnCollect(func() { collected++ })
+
+	expected := Snapshot{
+		{Name: "c", Help: "C.", Kind: KindCounter, LabelNames: []string{"code"}, Series: []Series{
+			{LabelValues: []string{"200"}, Value: 2},
+			{LabelValues: []string{"500"}, Value: 1},
+		}},
+		{Name: "g", Help: "G.", Kind: KindGauge, Series: []Series{{Value: 3}}},
+		{Name: "h", Help: "H.", Kind: KindHistogram, Buckets: []float64{1, 2}, Series: []Series{
+			{BucketCounts: []uint64{1, 1, 1}, Sum: 5.5, Count: 3},
+		}},
+	}
+	snap := r.Snapshot()
+	if !reflect.DeepEqual(snap, expected) {
+		t.Errorf("expected %+v, got %+v", expected, snap)
+	}
+	if collected != 1 {
+		t.Errorf("expected collector to be called once, got %d", collected)
+	}
+
+	// Snapshots are sent between processes as JSON.
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("expected %+v after decoding, got %+v", expected, decoded)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := Snapshot{
+		{Name: "c", Kind: KindCounter, LabelNames: []string{"code"}, Series: []Series{
+			{LabelValues: []string{"200"}, Value: 2},
+		}},
+		{Name: "h", Kind: KindHistogram, Buckets: []float64{1}, Series: []Series{
+			{BucketCounts: []uint64{1, 0}, Sum: 0.5, Count: 1},
+		}},
+	}
+	b := Snapshot{
+		{Name: "c", Kind: KindCounter, LabelNames: []string{"code"}, Series: []Series{
+			{LabelValues: []string{"200"}, Value: 1},
+			{LabelValues: []string{"500"}, Value: 1},
+		}},
+		{Name: "h", Kind: KindHistogram, Buckets: []float64{1}, Series: []Series{
+			{BucketCounts: []uint64{0, 1}, Sum: 2, Count: 1},
+		}},
+		// This conflicts with the first snapshot, so it's ignored.
+		{Name: "c", Kind: KindGauge, Series: []Series{{Value: 100}}},
+	}
+	expected := Snapshot{
+		{Name: "c", Kind: KindCounter, LabelNames: []string{"code"}, Series: []Series{
+			{LabelValues: []string{"200"}, Value: 3},
+			{LabelValues: []string{"500"}, Value: 1},
+		}},
+		{Name: "h", Kind: KindHistogram, Buckets: []float64{1}, Series: []Series{
+			{BucketCounts: []uint64{1, 1}, Sum: 2.5, Count: 2},
+		}},
+	}
+	if merged := Merge(a, b); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+
+	// The snapshots that were merged shouldn't be modified.
+	if a[1].Series[0].BucketCounts[1] != 0 {
+		t.Errorf("expected Merge not to modify its arguments")
+	}
+}
+
+func TestCumulative(t *testing.T) {
+	snap := Snapshot{
+		{Name: "c", Kind: KindCounter, Series: []Series{{Value: 1}}},
+		{Name: "g", Kind: KindGauge, Series: []Series{{Value: 2}}},
+		{Name: "h", Kind: KindHistogram, Buckets: []float64{1}, Series: []Series{
+			{BucketCounts: []uint64{1, 0}, Sum: 0.5, Count: 1},
+		}},
+	}
+	expected := Snapshot{snap[0], snap[2]}
+	if cumulative := snap.Cumulative(); !reflect.DeepEqual(cumulative, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cumulative)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c, _ := r.NewCounter("requests_total", "Requests\nserved.", "path")
+	h, _ := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "code")
+	c.Inc(`/"quoted"\`)
+	h.Observe(0.05, "200")
+	h.Observe(5, "200")
+
+	expected := strings.Join([]string{
+		`# HELP latency_seconds Latency.`,
+		`# TYPE latency_seconds histogram`,
+		`latency_seconds_bucket{code="200",le="0.1"} 1`,
+		`latency_seconds_bucket{code="200",le="1"} 1`,
+		`latency_seconds_bucket{code="200",le="+Inf"} 2`,
+		`latency_seconds_sum{code="200"} 5.05`,
+		`latency_seconds_count{code="200"} 2`,
+		`# HELP requests_total Requests\nserved.`,
+		`# TYPE requests_total counter`,
+		`requests_total{path="/\"quoted\"\\"} 1`,
+		``,
+	}, "\n")
+	var buf bytes.Buffer
+	if err := r.Snapshot().WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	Handler(r.Snapshot).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected Prometheus content type, got %q", ct)
+	}
+	if w.Body.String() != expected {
+		t.Errorf("expected handler to write the same text, got:\n%s", w.Body.String())
+	}
+}
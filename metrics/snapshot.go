@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Snapshot is a copy of the metrics in a registry at a point in time.
+// Families are sorted by name, and series by their label values.
+type Snapshot []Family
+
+// Family is a snapshot of a metric.
+type Family struct {
+	Name       string    `json:"name"`
+	Help       string    `json:"help"`
+	Kind       Kind      `json:"kind"`
+	LabelNames []string  `json:"label_names,omitempty"`
+	Buckets    []float64 `json:"buckets,omitempty"`
+	Series     []Series  `json:"series"`
+}
+
+// Series is a snapshot of a metric's value for one set of label values.
+// Counters and gauges use Value, and histograms use the rest. BucketCounts
+// aren't cumulative, and the last one is for the implicit +Inf bucket.
+type Series struct {
+	LabelValues  []string `json:"label_values,omitempty"`
+	Value        float64  `json:"value,omitempty"`
+	BucketCounts []uint64 `json:"bucket_counts,omitempty"`
+	Sum          float64  `json:"sum,omitempty"`
+	Count        uint64   `json:"count,omitempty"`
+}
+
+// Snapshot calls the registry's collectors, and then returns a copy of its
+// metrics.
+func (r *Registry) Snapshot() Snapshot {
+	r.mutex.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mutex.Unlock()
+	for _, fn := range collectors {
+		fn()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	snap := Snapshot{}
+	for _, f := range r.families {
+		sf := Family{
+			Name:       f.name,
+			Help:       f.help,
+			Kind:       f.kind,
+			LabelNames: append([]string(nil), f.labelNames...),
+			Buckets:    append([]float64(nil), f.buckets...),
+			Series:     []Series{},
+		}
+		for _, s := range f.series {
+			sf.Series = append(sf.Series, Series{
+				LabelValues:  append([]string(nil), s.labelValues...),
+				Value:        s.value,
+				BucketCounts: append([]uint64(nil), s.bucketCounts...),
+				Sum:          s.sum,
+				Count:        s.count,
+			})
+		}
+		snap = append(snap, sf)
+	}
+	snap.sort()
+	return snap
+}
+
+func (snap Snapshot) sort() {
+	sort.Slice(snap, func(i, j int) bool {
+		return snap[i].Name < snap[j].Name
+	})
+	for _, f := range snap {
+		series := f.Series
+		sort.Slice(series, func(i, j int) bool {
+			return lessStrings(series[i].LabelValues, series[j].LabelValues)
+		})
+	}
+}
+
+// Merge combines snapshots by adding together the series with the same names
+// and label values. This is used to combine the metrics from several
+// processes, so gauges are summed too. If a metric has a different kind,
+// labels, or buckets in different snapshots, the first one wins and the
+// others are ignored.
+func Merge(snaps ...Snapshot) Snapshot {
+	families := map[string]*Family{}
+	seriesIndex := map[string]int{}
+	for _, snap := range snaps {
+		for _, f := range snap {
+			mf, ok := families[f.Name]
+			if !ok {
+				mf = &Family{
+					Name:       f.Name,
+					Help:       f.Help,
+					Kind:       f.Kind,
+					LabelNames: f.LabelNames,
+					Buckets:    f.Buckets,
+					Series:     []Series{},
+				}
+				families[f.Name] = mf
+			} else if mf.Kind != f.Kind || !equalStrings(mf.LabelNames, f.LabelNames) ||
+				!equalFloats(mf.Buckets, f.Buckets) {
+				continue
+			}
+			for _, s := range f.Series {
+				key := f.Name + "\xff" + strings.Join(s.LabelValues, "\xff")
+				i, ok := seriesIndex[key]
+				if !ok {
+					seriesIndex[key] = len(mf.Series)
+					mf.Series = append(mf.Series, Series{
+						LabelValues:  s.LabelValues,
+						Value:        s.Value,
+						BucketCounts: append([]uint64(nil), s.BucketCounts...),
+						Sum:          s.Sum,
+						Count:        s.Count,
+					})
+					continue
+				}
+				ms := &mf.Series[i]
+				ms.Value += s.Value
+				ms.Sum += s.Sum
+				ms.Count += s.Count
+				for j := range ms.BucketCounts {
+					if j < len(s.BucketCounts) {
+						ms.BucketCounts[j] += s.BucketCounts[j]
+					}
+				}
+			}
+		}
+	}
+
+	merged := Snapshot{}
+	for _, f := range families {
+		merged = append(merged, *f)
+	}
+	merged.sort()
+	return merged
+}
+
+// Cumulative returns the counters and histograms in the snapshot, leaving
+// out the gauges. These are the metrics whose values only go up, which can be
+// kept after the process they came from has gone away.
+func (snap Snapshot) Cumulative() Snapshot {
+	cumulative := Snapshot{}
+	for _, f := range snap {
+		if f.Kind == KindCounter || f.Kind == KindHistogram {
+			cumulative = append(cumulative, f)
+		}
+	}
+	return cumulative
+}
+
+// WriteText writes the snapshot in the Prometheus text exposition format.
+func (snap Snapshot) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range snap {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.Name, f.Kind)
+		for _, s := range f.Series {
+			labels := formatLabels(f.LabelNames, s.LabelValues)
+			if f.Kind != KindHistogram {
+				fmt.Fprintf(bw, "%s%s %s\n", f.Name, labels, formatFloat(s.Value))
+				continue
+			}
+			var cumulative uint64
+			for i, n := range s.BucketCounts {
+				cumulative += n
+				le := "+Inf"
+				if i < len(f.Buckets) {
+					le = formatFloat(f.Buckets[i])
+				}
+				bucketLabels := formatLabels(append(append([]string{}, f.LabelNames...), "le"),
+					append(append([]string{}, s.LabelValues...), le))
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.Name, bucketLabels, cumulative)
+			}
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.Name, labels, formatFloat(s.Sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.Name, labels, s.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler that serves the snapshot returned by
+// gather in the Prometheus text exposition format.
+func Handler(gather func() Snapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		gather().WriteText(w)
+	})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+func lessStrings(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,173 @@
+package prefork
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// unixPrefix is the prefix for addresses that are Unix socket paths.
+const unixPrefix = "unix:"
+
+// listen returns the listeners for the manager. If the manager was started
+// by an old manager during an upgrade, it inherits the old manager's
+// listeners. If it was started by systemd's socket activation, it uses the
+// sockets from systemd. Otherwise, it creates new ones on the configured
+// addresses. It also returns the pid of the old manager, or 0 if there isn't
+// one.
+//
+// Unix sockets created here are removed when they're closed. Inherited ones
+// are left for whoever created them, until ownSockets is called.
+func listen(cfg Config, logger Logger) ([]net.Listener, int, error) {
+	if os.Getenv(listenFDEnv) != "" {
+		return inheritListeners(logger)
+	}
+
+	lns, err := systemdListeners()
+	if err != nil {
+		return nil, 0, err
+	} else if len(lns) > 0 {
+		for _, ln := range lns {
+			logger.Println("using socket from systemd on", formatAddr(ln.Addr()))
+		}
+		return lns, 0, nil
+	}
+
+	if len(cfg.Addrs) == 0 {
+		return nil, 0, errors.New("no addresses to listen on")
+	}
+	for _, addr := range cfg.Addrs {
+		ln, err := listenAddr(addr, cfg)
+		if err != nil {
+			closeListeners(lns)
+			return nil, 0, err
+		}
+		logger.Println("listening on", formatAddr(ln.Addr()))
+		lns = append(lns, ln)
+	}
+	return lns, 0, nil
+}
+
+// listenAddr creates a listener on the address. If it's a Unix socket, any
+// stale socket file left at the path is removed first, and the socket's
+// mode and owner are set from the config.
+func listenAddr(addr string, cfg Config) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating listener")
+		}
+		return ln, nil
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating listener")
+	}
+	if cfg.SocketMode != 0 {
+		if err := os.Chmod(path, cfg.SocketMode); err != nil {
+			ln.Close()
+			return nil, errors.Wrap(err, "error setting socket mode")
+		}
+	}
+	if cfg.SocketOwner != "" {
+		uid, gid, err := lookupOwner(cfg.SocketOwner)
+		if err == nil {
+			err = errors.Wrap(os.Lchown(path, uid, gid), "error setting socket owner")
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the Unix socket at path if nothing is listening
+// on it, as happens when a process is killed before it can clean up.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		// If it's not a socket, listening will fail with a useful error.
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.Errorf("error creating listener: %s is in use", path)
+	}
+	return errors.Wrap(os.Remove(path), "error removing stale socket")
+}
+
+// lookupOwner returns the user and group ids for an owner like "user",
+// "user:group", or ":group". The user or group is -1 if it isn't given.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		if uid, err = strconv.Atoi(parts[0]); err != nil {
+			u, err := user.Lookup(parts[0])
+			if err != nil {
+				return 0, 0, errors.Wrap(err, "error looking up socket owner")
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return 0, 0, errors.Wrap(err, "error looking up socket group")
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// listenerFile returns a copy of the listener's file descriptor, so it can be
+// passed to another process.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	fl, ok := ln.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.Errorf("can't get file for %s listener", ln.Addr().Network())
+	}
+	f, err := fl.File()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting file for listener")
+	}
+	return f, nil
+}
+
+// formatAddr formats the listener's address the way it would be configured.
+func formatAddr(addr net.Addr) string {
+	if strings.HasPrefix(addr.Network(), "unix") {
+		return unixPrefix + addr.String()
+	}
+	return addr.String()
+}
+
+// ownSockets makes the Unix sockets inherited from an old manager get removed
+// when they're closed, once the old manager has been told to stop.
+func ownSockets(lns []net.Listener) {
+	for _, ln := range lns {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+	}
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
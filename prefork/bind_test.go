@@ -0,0 +1,133 @@
+package prefork
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenAddrUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+
+	// A stale socket, left behind by a process that was killed.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	cfg := Config{SocketMode: 0600, SocketOwner: owner}
+	ln, err := listenAddr("unix:"+path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode() & os.ModePerm; mode != 0600 {
+		t.Errorf("expected mode 0600, got %o", mode)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid() {
+		t.Errorf("expected owner %s, got %d:%d", owner, st.Uid, st.Gid)
+	}
+
+	if _, err := listenAddr("unix:"+path, cfg); err == nil {
+		t.Error("expected error for a socket that's in use, got nil")
+	}
+
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	for owner, expected := range map[string][2]int{
+		"1000":      {1000, -1},
+		"1000:100":  {1000, 100},
+		":100":      {-1, 100},
+		"root":      {0, -1},
+		"root:root": {0, 0},
+	} {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			t.Errorf("%s: %s", owner, err)
+		} else if uid != expected[0] || gid != expected[1] {
+			t.Errorf("%s: expected %v, got [%d %d]", owner, expected, uid, gid)
+		}
+	}
+	if _, _, err := lookupOwner("no-such-user-here"); err == nil {
+		t.Error("expected error for unknown user, got nil")
+	}
+}
+
+func TestManagerBinds(t *testing.T) {
+	os.Setenv("TEST_WORKER", "serve")
+	dir, err := ioutil.TempDir("", "prefork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+
+	logger := newTestLogger(t)
+	cfg := Config{NumWorkers: 1, Addrs: []string{"127.0.0.1:0", "unix:" + path}}
+	lns, _, err := listen(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnfs := make([]*os.File, len(lns))
+	for i, ln := range lns {
+		if lnfs[i], err = listenerFile(ln); err != nil {
+			t.Fatal(err)
+		}
+		defer lnfs[i].Close()
+	}
+	m := newManager(cfg, lnfs, logger)
+	done := make(chan struct{})
+	go func() {
+		m.run()
+		closeListeners(lns)
+		close(done)
+	}()
+
+	pid, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	if got := get(t, "http://"+lns[0].Addr().String()+"/"); got != pid {
+		t.Errorf("expected a response from worker %d over TCP, got %d", pid, got)
+	}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := unixClient.Get("http://whiskey/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, _ := strconv.Atoi(string(b)); got != pid {
+		t.Errorf("expected a response from worker %d over the Unix socket, got %q", pid, b)
+	}
+
+	m.signals <- syscall.SIGQUIT
+	<-done
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -4,46 +4,58 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // WorkerListener is a wrapper around a net.Listener that adds helpful things
 // that prefork workers will often need. It limits the number of simultaneous
 // connections to the specified value, and sets keep alive on the accepted
-// conn to the given duration.
+// conn to the given duration, if it's a TCP connection. If numConns is 0, the
+// number of connections isn't limited.
 //
 // Usage of this in workers is completely optional.
 func WorkerListener(l net.Listener, numConns int, keepAlivePeriod time.Duration) net.Listener {
-	return &workerListener{
-		TCPListener:     l.(*net.TCPListener),
-		throttle:        make(chan struct{}, numConns),
+	wl := &workerListener{
+		Listener:        l,
 		keepAlivePeriod: keepAlivePeriod,
 	}
+	if numConns > 0 {
+		wl.throttle = make(chan struct{}, numConns)
+	}
+	return wl
 }
 
 type workerListener struct {
-	*net.TCPListener
+	net.Listener
 	throttle        chan struct{}
 	keepAlivePeriod time.Duration
 }
 
 func (wl workerListener) acquire() {
-	wl.throttle <- struct{}{}
+	if wl.throttle != nil {
+		wl.throttle <- struct{}{}
+	}
 }
 
 func (wl workerListener) release() {
-	<-wl.throttle
+	if wl.throttle != nil {
+		<-wl.throttle
+	}
 }
 
 func (wl workerListener) Accept() (net.Conn, error) {
 	wl.acquire()
-	tc, err := wl.TCPListener.AcceptTCP()
+	c, err := wl.Listener.Accept()
 	if err != nil {
 		wl.release()
 		return nil, err
 	}
-	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(wl.keepAlivePeriod)
-	return &workerConn{Conn: tc, release: wl.release}, nil
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(wl.keepAlivePeriod)
+	}
+	return &workerConn{Conn: c, release: wl.release}, nil
 }
 
 type workerConn struct {
@@ -57,3 +69,82 @@ func (wc *workerConn) Close() error {
 	wc.releaseOnce.Do(wc.release)
 	return err
 }
+
+// errListenerClosed is returned by a multiListener's Accept after it's been
+// closed.
+var errListenerClosed = errors.New("use of closed listener")
+
+// MultiListener returns a listener that accepts connections from all of the
+// listeners. Its address is the address of the first one. Closing it closes
+// all of them. If there's only one listener, it's returned as is.
+func MultiListener(lns ...net.Listener) net.Listener {
+	if len(lns) == 1 {
+		return lns[0]
+	}
+	ml := &multiListener{
+		lns:   lns,
+		conns: make(chan acceptResult),
+		done:  make(chan struct{}),
+	}
+	for _, ln := range lns {
+		go ml.accept(ln)
+	}
+	return ml
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type multiListener struct {
+	lns       []net.Listener
+	conns     chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// accept accepts connections from one of the listeners, until it returns an
+// error that isn't temporary or the multiListener is closed.
+func (ml *multiListener) accept(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		select {
+		case ml.conns <- acceptResult{c, err}:
+		case <-ml.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Temporary()) {
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.conns:
+		return r.conn, r.err
+	case <-ml.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, ln := range ml.lns {
+			if closeErr := ln.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (ml *multiListener) Addr() net.Addr {
+	return ml.lns[0].Addr()
+}
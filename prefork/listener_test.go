@@ -1,7 +1,10 @@
 package prefork
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -64,3 +67,92 @@ func TestWorkerListener(t *testing.T) {
 		t.Fatalf("expected 3 conns, got %d", len(conns))
 	}
 }
+
+func TestWorkerListenerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	wl := WorkerListener(l, 1, 30*time.Second)
+	go func() {
+		c, err := net.Dial("unix", l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := wl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestWorkerListenerUnlimited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	wl := WorkerListener(l, 0, 30*time.Second)
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c, err = wl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	var lns []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, l)
+	}
+	ml := MultiListener(lns...)
+	if ml.Addr() != lns[0].Addr() {
+		t.Errorf("expected address %s, got %s", lns[0].Addr(), ml.Addr())
+	}
+
+	for _, l := range lns {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ac, err := ml.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ac.LocalAddr().String() != l.Addr().String() {
+			t.Errorf("expected a connection to %s, got %s", l.Addr(), ac.LocalAddr())
+		}
+		ac.Close()
+	}
+
+	ml.Close()
+	if _, err := ml.Accept(); err == nil {
+		t.Error("expected error after close, got nil")
+	}
+	for _, l := range lns {
+		if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			t.Errorf("expected %s to be closed", l.Addr())
+		}
+	}
+}
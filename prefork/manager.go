@@ -9,25 +9,254 @@
 package prefork
 
 import (
+	"encoding/json"
 	"fmt"
-	"net"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/noonat/whiskey/metrics"
 	"github.com/pkg/errors"
 )
 
-func execWorker(wg *sync.WaitGroup, lnf *os.File, env []string, logger Logger) (*Pipe, error) {
+const (
+	// tickInterval is how often the manager checks on its workers.
+	tickInterval = 100 * time.Millisecond
+
+	// crashWindow is how long a worker has to stay up before the manager
+	// stops considering it to be crash looping.
+	crashWindow = 5 * time.Second
+
+	// memoryCheckInterval is how often the manager checks its workers'
+	// memory against the limits.
+	memoryCheckInterval = time.Second
+
+	// minRestartDelay and maxRestartDelay bound the exponential backoff used
+	// when restarting crash looping workers.
+	minRestartDelay = 100 * time.Millisecond
+	maxRestartDelay = 30 * time.Second
+)
+
+// Config controls the behavior of the manager and its workers.
+type Config struct {
+	// Addrs are the addresses the manager listens on. TCP addresses are
+	// given as "host:port", and Unix socket paths as "unix:/path/to/socket".
+	// Connections to any of them are passed to the workers.
+	Addrs []string
+
+	// SocketMode is the file mode of the Unix sockets the manager creates,
+	// if it's non-zero. SocketOwner is their owner, as "user", "user:group",
+	// or ":group", if it's set. Either can be a name or a numeric id.
+	SocketMode  os.FileMode
+	SocketOwner string
+
+	// NumWorkers is the number of worker processes the manager keeps running.
+	// If it's 0, the worker runs in the manager process instead.
+	NumWorkers int
+
+	// Timeout is how long a worker can go without sending a heartbeat to the
+	// manager before the manager kills it. If it's 0, workers are never
+	// killed for being unresponsive.
+	Timeout time.Duration
+
+	// StatusAddr is the address the manager serves its status on, as JSON,
+	// including the stats reported by each worker. If it's empty, the status
+	// isn't served.
+	StatusAddr string
+
+	// MetricsAddr is the address the manager serves metrics on, in the
+	// Prometheus text format. The metrics in each worker's metrics.Default
+	// registry are sent to the manager and summed. If it's empty, metrics
+	// aren't collected from the workers or served.
+	MetricsAddr string
+
+	// StatsInterval is how often the manager logs the stats reported by its
+	// workers. If it's 0, the stats aren't logged.
+	StatsInterval time.Duration
+
+	// SoftMemoryLimit and HardMemoryLimit limit the resident memory of each
+	// worker, in bytes. Workers over the soft limit are replaced gracefully,
+	// one at a time, and workers over the hard limit are killed. The memory
+	// is read from /proc, so the limits only work on Linux. If they're 0,
+	// there's no limit.
+	SoftMemoryLimit int64
+	HardMemoryLimit int64
+
+	// SoftHeapLimit and HardHeapLimit do the same for the heap size reported
+	// by workers that implement HeapReporter.
+	SoftHeapLimit int64
+	HardHeapLimit int64
+
+	// GracefulTimeout is how long a worker has to finish its active requests
+	// when it's stopped gracefully, before it's killed. If it's 0, workers
+	// wait for their requests indefinitely.
+	GracefulTimeout time.Duration
+
+	// Reload is called when the manager receives SIGHUP, before it replaces
+	// the workers. It can update the config; changes to the listener
+	// settings are ignored, as the manager keeps its existing listener. If
+	// it's nil, the workers are replaced with the same config.
+	Reload func(cfg *Config) error
+
+	// ReloadInPlace makes SIGHUP reload the workers in place instead of
+	// replacing them. The manager still calls Reload, and then sends SIGHUP
+	// to the workers, which reload what they can if they're Reloaders.
+	ReloadInPlace bool
+}
+
+// workerProcess tracks a worker process started by the manager.
+type workerProcess struct {
+	cmd     *exec.Cmd
+	pipe    *Pipe
+	started time.Time
+
+	// heartbeat is the time of the last heartbeat from the worker, in
+	// nanoseconds since the epoch. It's updated by the goroutine reading from
+	// the pipe, so it must be accessed atomically.
+	heartbeat int64
+
+	killed bool
+
+	// heapSize is the last heap size reported by the worker, or 0 if it
+	// hasn't reported one. It's set by the goroutine reading from the pipe,
+	// so it must be accessed atomically.
+	heapSize int64
+
+	// retireRequested is set to 1 when the worker asks to be replaced. It's
+	// set by the goroutine reading from the pipe, so it must be accessed
+	// atomically.
+	retireRequested int32
+
+	// retiring is set when the worker is being replaced. It keeps serving
+	// until its replacements are ready, and then it's stopped gracefully.
+	retiring bool
+
+	// stopping is set once the worker has been told to stop. If it hasn't
+	// exited by stopDeadline, it's killed.
+	stopping     bool
+	stopDeadline time.Time
+
+	// stats and metrics are the last snapshots sent by the worker, as JSON.
+	statsMutex sync.Mutex
+	stats      json.RawMessage
+	metrics    json.RawMessage
+}
+
+func (wp *workerProcess) pid() int {
+	return wp.cmd.Process.Pid
+}
+
+// lastHeartbeat returns the time that the worker last sent a heartbeat.
+func (wp *workerProcess) lastHeartbeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&wp.heartbeat))
+}
+
+// lastStats returns the last stats snapshot sent by the worker, or nil if
+// it hasn't sent one.
+func (wp *workerProcess) lastStats() json.RawMessage {
+	wp.statsMutex.Lock()
+	defer wp.statsMutex.Unlock()
+	return wp.stats
+}
+
+// lastMetrics returns the last metrics snapshot sent by the worker, or nil if
+// it hasn't sent one.
+func (wp *workerProcess) lastMetrics() json.RawMessage {
+	wp.statsMutex.Lock()
+	defer wp.statsMutex.Unlock()
+	return wp.metrics
+}
+
+// ready returns true once the worker has sent its first heartbeat.
+func (wp *workerProcess) ready() bool {
+	return atomic.LoadInt64(&wp.heartbeat) > wp.started.UnixNano()
+}
+
+// active returns true if the worker counts towards the configured number of
+// workers, i.e. it isn't being replaced or stopped.
+func (wp *workerProcess) active() bool {
+	return !wp.retiring && !wp.stopping
+}
+
+// manager supervises the worker processes. Its state is only changed by the
+// goroutine running the run loop, which holds mutex while it does so, so the
+// status can be read from other goroutines.
+type manager struct {
+	mutex  sync.Mutex
+	cfg    Config
+	logger Logger
+	lnfs   []*os.File
+	env    []string
+
+	workers      map[int]*workerProcess
+	exited       chan *workerProcess
+	signals      chan os.Signal
+	stopping     bool
+	restartDelay time.Duration
+	nextStart    time.Time
+
+	// exitedMetrics is the sum of the counters and histograms last sent by
+	// workers that have exited, so that the totals don't go backwards when
+	// workers are replaced.
+	exitedMetrics metrics.Snapshot
+
+	// nextMemoryCheck is when the workers' memory is next checked against
+	// the limits.
+	nextMemoryCheck time.Time
+
+	// upgrading is the new manager that's replacing this one, if any, and
+	// parentPID is the old manager that this one is replacing, until it's
+	// been told to stop.
+	upgrading     *exec.Cmd
+	upgradeExited chan *exec.Cmd
+	parentPID     int
+
+	// notifier sends the manager's state to systemd. ready is set while
+	// systemd has been told the manager is ready, and started is set once
+	// it's been ready at least once. replaced is set once a new manager has
+	// taken over, after which this one doesn't send systemd anything.
+	notifier *notifier
+	ready    bool
+	started  bool
+	replaced bool
+}
+
+func newManager(cfg Config, lnfs []*os.File, logger Logger) *manager {
+	env := append([]string{}, os.Environ()...)
+	env = append(env, "PREFORK_WORKER=1", numListenersEnv+"="+strconv.Itoa(len(lnfs)))
+	return &manager{
+		cfg:     cfg,
+		logger:  logger,
+		lnfs:    lnfs,
+		env:     env,
+		workers: map[int]*workerProcess{},
+		exited:  make(chan *workerProcess),
+		signals: make(chan os.Signal, 10),
+
+		upgradeExited: make(chan *exec.Cmd, 1),
+	}
+}
+
+// startWorker starts a new worker process.
+func (m *manager) startWorker() (*workerProcess, error) {
 	mp, wp, err := NewPipes()
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating worker pipes")
 	}
 
 	cmd := exec.Command(os.Args[0], os.Args[1:]...)
-	cmd.Env = env
-	cmd.ExtraFiles = []*os.File{lnf, wp.ReadFile, wp.WriteFile}
+	cmd.Env = m.env
+	// The first listener is always FD 3 and the pipe is FDs 4 and 5, so
+	// workers built before there could be more than one listener still work.
+	cmd.ExtraFiles = append([]*os.File{m.lnfs[0], wp.ReadFile, wp.WriteFile}, m.lnfs[1:]...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	if err := cmd.Start(); err != nil {
@@ -35,114 +264,604 @@ func execWorker(wg *sync.WaitGroup, lnf *os.File, env []string, logger Logger) (
 		wp.Close()
 		return nil, errors.Wrap(err, "error starting worker")
 	}
+	// The worker has its own copies of these now.
+	wp.Close()
 
-	// Workers processes should gracefully stop when they receieve an
-	// interrupt. Ignore the first interrupt we receive, to give them a chance
-	// to stop. But if we receive a second one, allow this process to stop.
-	closing := false
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	go func() {
-		<-interrupt
-		signal.Stop(interrupt)
-		closing = true
-	}()
+	now := time.Now()
+	w := &workerProcess{
+		cmd:       cmd,
+		pipe:      mp,
+		started:   now,
+		heartbeat: now.UnixNano(),
+	}
 
-	// This keepalive communication between processes isn't very advanced
-	// right now. It just writes a byte 1 once a second from the worker to
-	// the manager to indicate that it's still alive. When it is shutting
-	// down, it sends a 0.
-	//
-	// This pipe will eventually be used to communicate things like stats
-	// up to the manager, to coordinate shutdown, etc.
+	// Read messages from the worker until it exits.
 	go func() {
-		b := []byte{1}
 		for {
-			_, err := mp.Read(b)
+			msg, err := mp.Recv()
 			if err != nil {
-				if !closing {
-					logger.Println("error reading keepalive:", err)
+				if err != io.EOF {
+					m.logger.Printf("error reading from worker %d: %s", w.pid(), err)
 				}
 				break
 			}
-			if b[0] == 0 {
-				break
+			switch msg.Type {
+			case MessageHeartbeat:
+				atomic.StoreInt64(&w.heartbeat, time.Now().UnixNano())
+			case MessageShutdown:
+				// The manager finds out when the process exits.
+			case MessageStats:
+				w.statsMutex.Lock()
+				w.stats = msg.Body
+				w.statsMutex.Unlock()
+			case MessageMetrics:
+				w.statsMutex.Lock()
+				w.metrics = msg.Body
+				w.statsMutex.Unlock()
+			case MessageRetire:
+				atomic.StoreInt32(&w.retireRequested, 1)
+			case MessageHeap:
+				var n int64
+				if err := json.Unmarshal(msg.Body, &n); err != nil {
+					m.logger.Printf("error decoding heap size from worker %d: %s", w.pid(), err)
+					break
+				}
+				atomic.StoreInt64(&w.heapSize, n)
+			default:
+				m.logger.Printf("unexpected %s message from worker %d", msg.Type, w.pid())
 			}
 		}
 	}()
 
-	go func(cmd *exec.Cmd) {
-		pid := cmd.Process.Pid
-		if err := cmd.Wait(); err != nil {
-			logger.Printf("worker %d wait returned error: %s", pid, err)
-		} else {
-			logger.Printf("worker %d stopped", pid)
-		}
-		wg.Done()
-		wp.Close()
+	go func() {
+		cmd.Wait()
 		mp.Close()
-	}(cmd)
+		m.exited <- w
+	}()
 
-	return mp, nil
+	return w, nil
+}
+
+// activeWorkers returns the workers that count towards the configured number
+// of workers, oldest first.
+func (m *manager) activeWorkers() []*workerProcess {
+	var active []*workerProcess
+	for _, w := range m.workers {
+		if w.active() {
+			active = append(active, w)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].started.Before(active[j].started)
+	})
+	return active
+}
+
+// startWorkers starts enough workers to bring the number of active workers up
+// to the configured count. If workers have been crashing, this waits until
+// the restart delay has passed.
+func (m *manager) startWorkers() {
+	if m.stopping || time.Now().Before(m.nextStart) {
+		return
+	}
+	for n := len(m.activeWorkers()); n < m.cfg.NumWorkers; n++ {
+		w, err := m.startWorker()
+		if err != nil {
+			m.logger.Printf("%+v\n", err)
+			m.delayRestart()
+			return
+		}
+		m.workers[w.pid()] = w
+		m.logger.Printf("started worker %d", w.pid())
+	}
+}
+
+// delayRestart increases the delay before new workers are started, doubling
+// it each time, up to maxRestartDelay.
+func (m *manager) delayRestart() {
+	m.restartDelay *= 2
+	if m.restartDelay < minRestartDelay {
+		m.restartDelay = minRestartDelay
+	} else if m.restartDelay > maxRestartDelay {
+		m.restartDelay = maxRestartDelay
+	}
+	m.nextStart = time.Now().Add(m.restartDelay)
+	m.logger.Printf("workers are crashing, waiting %s before starting more", m.restartDelay)
 }
 
-func runManager(w Worker, addr string, numWorkers int, logger Logger) error {
+// handleExit is called when a worker process exits.
+func (m *manager) handleExit(w *workerProcess) {
+	delete(m.workers, w.pid())
+	if snap, ok := m.decodeMetrics(w); ok {
+		m.exitedMetrics = metrics.Merge(m.exitedMetrics, snap.Cumulative())
+	}
+	if m.stopping || w.stopping {
+		m.logger.Printf("worker %d stopped", w.pid())
+		return
+	}
+	m.logger.Printf("worker %d exited unexpectedly: %s", w.pid(), w.cmd.ProcessState)
+	workerRestarts.Inc()
+	if time.Since(w.started) < crashWindow {
+		m.delayRestart()
+	} else {
+		m.restartDelay = 0
+	}
+}
+
+// killUnresponsive kills any workers that haven't sent a heartbeat within the
+// configured timeout.
+func (m *manager) killUnresponsive() {
+	if m.cfg.Timeout <= 0 {
+		return
+	}
+	for pid, w := range m.workers {
+		if w.killed || time.Since(w.lastHeartbeat()) < m.cfg.Timeout {
+			continue
+		}
+		m.logger.Printf("worker %d hasn't responded in %s, killing it", pid, m.cfg.Timeout)
+		if err := w.cmd.Process.Kill(); err != nil {
+			m.logger.Printf("error killing worker %d: %s", pid, err)
+			continue
+		}
+		w.killed = true
+	}
+}
+
+// checkMemory replaces workers that are over the soft memory or heap limits,
+// and kills workers that are over the hard limits.
+func (m *manager) checkMemory() {
+	cfg := m.cfg
+	if cfg.SoftMemoryLimit <= 0 && cfg.HardMemoryLimit <= 0 &&
+		cfg.SoftHeapLimit <= 0 && cfg.HardHeapLimit <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Before(m.nextMemoryCheck) {
+		return
+	}
+	m.nextMemoryCheck = now.Add(memoryCheckInterval)
+
+	// Workers over the soft limit are replaced one at a time, so that a limit
+	// that new workers are already over doesn't start an endless number of
+	// them.
+	replacing := false
+	for _, w := range m.workers {
+		if w.retiring && !w.stopping {
+			replacing = true
+		}
+	}
+	for pid, w := range m.workers {
+		if w.killed {
+			continue
+		}
+		over, usage := underLimits, ""
+		if cfg.SoftMemoryLimit > 0 || cfg.HardMemoryLimit > 0 {
+			if rss, err := processRSS(pid); err == nil {
+				over = checkLimits(rss, cfg.SoftMemoryLimit, cfg.HardMemoryLimit)
+				usage = fmt.Sprintf("is using %d bytes of memory", rss)
+			}
+		}
+		heap := atomic.LoadInt64(&w.heapSize)
+		if o := checkLimits(heap, cfg.SoftHeapLimit, cfg.HardHeapLimit); o > over {
+			over, usage = o, fmt.Sprintf("has a heap size of %d", heap)
+		}
+		switch over {
+		case overHardLimit:
+			m.logger.Printf("worker %d %s, over the hard limit, killing it", pid, usage)
+			if err := w.cmd.Process.Kill(); err != nil {
+				m.logger.Printf("error killing worker %d: %s", pid, err)
+				continue
+			}
+			w.killed = true
+		case overSoftLimit:
+			if w.active() && !m.stopping && !replacing {
+				m.logger.Printf("worker %d %s, over the soft limit, replacing it", pid, usage)
+				w.retiring = true
+				replacing = true
+			}
+		}
+	}
+}
+
+// These are the results of checkLimits.
+const (
+	underLimits = iota
+	overSoftLimit
+	overHardLimit
+)
+
+// checkLimits returns whether n is over the soft or hard limit. Limits that
+// are 0 are ignored.
+func checkLimits(n, soft, hard int64) int {
+	switch {
+	case hard > 0 && n > hard:
+		return overHardLimit
+	case soft > 0 && n > soft:
+		return overSoftLimit
+	}
+	return underLimits
+}
+
+// stopWorker tells a worker to stop, either gracefully or immediately. Either
+// way, it's killed if it hasn't exited within the graceful timeout.
+func (m *manager) stopWorker(w *workerProcess, graceful bool) {
+	msg, sig := Message{Type: MessageShutdown}, syscall.SIGQUIT
+	if graceful {
+		msg, sig = Message{Type: MessageDrain}, syscall.SIGTERM
+	}
+	if err := w.pipe.Send(msg); err != nil {
+		// Fall back to a signal if the pipe is broken.
+		if err := w.cmd.Process.Signal(sig); err != nil {
+			m.logger.Printf("error sending %s to worker %d: %s", sig, w.pid(), err)
+		}
+	}
+	if !w.stopping {
+		w.stopping = true
+		w.stopDeadline = time.Now().Add(m.cfg.GracefulTimeout)
+	}
+}
+
+// killStopping kills any workers that haven't exited within the graceful
+// timeout after being told to stop.
+func (m *manager) killStopping() {
+	if m.cfg.GracefulTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	for pid, w := range m.workers {
+		if !w.stopping || w.killed || now.Before(w.stopDeadline) {
+			continue
+		}
+		m.logger.Printf("worker %d didn't stop within %s, killing it", pid, m.cfg.GracefulTimeout)
+		if err := w.cmd.Process.Kill(); err != nil {
+			m.logger.Printf("error killing worker %d: %s", pid, err)
+			continue
+		}
+		w.killed = true
+	}
+}
+
+// workersReady returns true if the configured number of workers are active
+// and ready to serve requests.
+func (m *manager) workersReady() bool {
+	active := m.activeWorkers()
+	if len(active) < m.cfg.NumWorkers {
+		return false
+	}
+	for _, w := range active {
+		if !w.ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// retireRequested marks the workers that have asked to be replaced as
+// retiring, so that replacements are started for them. They keep serving
+// until the replacements are ready.
+func (m *manager) retireRequested() {
+	if m.stopping {
+		return
+	}
+	for pid, w := range m.workers {
+		if w.active() && atomic.LoadInt32(&w.retireRequested) != 0 {
+			m.logger.Printf("worker %d asked to be replaced", pid)
+			w.retiring = true
+		}
+	}
+}
+
+// stopRetiring gracefully stops the retiring workers, once all of the workers
+// replacing them are ready to serve requests.
+func (m *manager) stopRetiring() {
+	if !m.workersReady() {
+		return
+	}
+	for _, w := range m.workers {
+		if w.retiring && !w.stopping {
+			m.logger.Printf("stopping worker %d", w.pid())
+			m.stopWorker(w, true)
+		}
+	}
+}
+
+// stopExtra gracefully stops the oldest workers, if there are more than the
+// configured number running.
+func (m *manager) stopExtra() {
+	active := m.activeWorkers()
+	for i := 0; i < len(active)-m.cfg.NumWorkers; i++ {
+		m.logger.Printf("stopping worker %d", active[i].pid())
+		m.stopWorker(active[i], true)
+	}
+}
+
+// reload reloads the config, and replaces all of the workers with new ones.
+// The old workers keep serving requests until the new ones are ready. If
+// ReloadInPlace is set, the workers are told to reload instead, and are only
+// started or stopped to match the new number of workers.
+func (m *manager) reload() {
+	if m.cfg.Reload != nil {
+		cfg := m.cfg
+		if err := cfg.Reload(&cfg); err != nil {
+			m.logger.Printf("error reloading config: %+v\n", err)
+			return
+		}
+		cfg.Addrs = m.cfg.Addrs
+		cfg.SocketMode = m.cfg.SocketMode
+		cfg.SocketOwner = m.cfg.SocketOwner
+		m.cfg = cfg
+	}
+	m.notifyReloading()
+	if m.cfg.ReloadInPlace {
+		m.logger.Println("reloading", len(m.activeWorkers()), "workers in place")
+		// Workers that are still starting up might not be handling
+		// signals yet, and will load the new config anyway.
+		for pid, w := range m.workers {
+			if !w.ready() {
+				continue
+			}
+			if err := w.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+				m.logger.Printf("error sending %s to worker %d: %s", syscall.SIGHUP, pid, err)
+			}
+		}
+		m.startWorkers()
+		m.stopExtra()
+		return
+	}
+	m.logger.Println("reloading, replacing", m.cfg.NumWorkers, "workers")
+	for _, w := range m.workers {
+		if w.active() {
+			w.retiring = true
+		}
+	}
+	m.startWorkers()
+}
+
+// reopenLogs reopens the manager's log files, if it has any, and tells the
+// workers to do the same.
+func (m *manager) reopenLogs() {
+	if r, ok := m.logger.(LogReopener); ok {
+		if err := r.ReopenLogs(); err != nil {
+			m.logger.Println("error reopening logs:", err)
+		}
+	}
+	m.signalWorkers(syscall.SIGUSR1)
+}
+
+// handleSignal responds to a signal sent to the manager.
+func (m *manager) handleSignal(sig os.Signal) {
+	switch sig {
+	case syscall.SIGTERM:
+		m.shutdown(true)
+	case syscall.SIGINT, syscall.SIGQUIT:
+		if m.stopping {
+			// A second fast stop doesn't wait for anything.
+			m.logger.Println("killing workers")
+			m.signalWorkers(os.Kill)
+			return
+		}
+		m.shutdown(false)
+	case syscall.SIGHUP:
+		m.reload()
+	case syscall.SIGTTIN:
+		m.cfg.NumWorkers++
+		m.logger.Println("increasing worker count to", m.cfg.NumWorkers)
+		m.startWorkers()
+	case syscall.SIGTTOU:
+		if m.cfg.NumWorkers > 1 {
+			m.cfg.NumWorkers--
+			m.logger.Println("decreasing worker count to", m.cfg.NumWorkers)
+			m.stopExtra()
+		}
+	case syscall.SIGUSR1:
+		m.reopenLogs()
+	case syscall.SIGUSR2:
+		m.upgrade()
+	}
+}
+
+// signalWorkers sends a signal to all of the running workers.
+func (m *manager) signalWorkers(sig os.Signal) {
+	for pid, w := range m.workers {
+		if err := w.cmd.Process.Signal(sig); err != nil {
+			m.logger.Printf("error sending %s to worker %d: %s", sig, pid, err)
+		}
+	}
+}
+
+// run supervises the workers until the manager is told to stop. It keeps the
+// configured number of workers running, restarting them when they exit, and
+// killing them when they become unresponsive.
+func (m *manager) run() {
+	signal.Notify(m.signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT,
+		syscall.SIGTERM, syscall.SIGTTIN, syscall.SIGTTOU, syscall.SIGUSR1,
+		syscall.SIGUSR2)
+	defer signal.Stop(m.signals)
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	var stats <-chan time.Time
+	if m.cfg.StatsInterval > 0 {
+		statsTicker := time.NewTicker(m.cfg.StatsInterval)
+		defer statsTicker.Stop()
+		stats = statsTicker.C
+	}
+
+	if m.cfg.StatusAddr != "" {
+		srv := &http.Server{Addr: m.cfg.StatusAddr, Handler: http.HandlerFunc(m.serveStatus)}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				m.logger.Printf("%+v\n", errors.Wrap(err, "error serving status"))
+			}
+		}()
+		defer srv.Close()
+		m.logger.Println("serving status on", m.cfg.StatusAddr)
+	}
+
+	if m.cfg.MetricsAddr != "" {
+		srv := serveMetrics(m.cfg.MetricsAddr, m.gatherMetrics, m.logger)
+		defer srv.Close()
+	}
+
+	m.logger.Println("starting", m.cfg.NumWorkers, "workers")
+	m.mutex.Lock()
+	m.notifier = newNotifier(m.parentPID)
+	m.notify("STATUS=starting " + strconv.Itoa(m.cfg.NumWorkers) + " workers")
+	m.startWorkers()
+	m.mutex.Unlock()
+	for !m.stopping || len(m.workers) > 0 {
+		var handle func()
+		select {
+		case sig := <-m.signals:
+			handle = func() { m.handleSignal(sig) }
+		case w := <-m.exited:
+			handle = func() { m.handleExit(w) }
+		case cmd := <-m.upgradeExited:
+			handle = func() { m.handleUpgradeExit(cmd) }
+		case <-stats:
+			handle = m.logStats
+		case <-ticker.C:
+			handle = func() {
+				m.killUnresponsive()
+				m.killStopping()
+				m.checkMemory()
+				m.retireRequested()
+				m.startWorkers()
+				m.stopRetiring()
+				m.notifyReady()
+				m.pingWatchdog()
+				m.finishUpgrade()
+			}
+		}
+		m.mutex.Lock()
+		handle()
+		m.mutex.Unlock()
+	}
+}
+
+// shutdown tells the workers to stop, either gracefully or immediately, and
+// stops restarting them.
+func (m *manager) shutdown(graceful bool) {
+	if m.stopping && graceful {
+		return
+	}
+	if graceful {
+		m.logger.Println("stopping workers gracefully")
+	} else {
+		m.logger.Println("stopping workers")
+	}
+	m.stopping = true
+	if m.upgrading != nil {
+		// It's the new manager that's stopping this one, and systemd is
+		// already tracking it as the main process. Telling systemd that
+		// this one is stopping would stop the whole service.
+		m.replaced = true
+	}
+	m.notifyStopping()
+	for _, w := range m.workers {
+		m.stopWorker(w, graceful)
+	}
+}
+
+func runManager(w Worker, cfg Config, logger Logger) error {
 	logger.SetPrefix(fmt.Sprintf("manager\t[%d]\t", os.Getpid()))
 
-	ln, err := net.Listen("tcp", addr)
+	lns, parentPID, err := listen(cfg, logger)
 	if err != nil {
-		return errors.Wrap(err, "error creating listener")
+		return err
 	}
-	logger.Println("listening on", addr)
 
-	if numWorkers == 0 {
-		// FIXME: it might be better to reuse the code in worker.go, so that
-		// listener would get closed on sigint.
+	if cfg.NumWorkers == 0 {
 		logger.Println("worker count is 0, running in single process mode")
-		return w.Serve(ln, logger)
+		if cfg.MetricsAddr != "" {
+			srv := serveMetrics(cfg.MetricsAddr, metrics.Default.Snapshot, logger)
+			defer srv.Close()
+		}
+		state := []string{"READY=1", "STATUS=serving in single process mode"}
+		if parentPID != 0 {
+			state = append(state, "MAINPID="+strconv.Itoa(os.Getpid()))
+		}
+		n := newNotifier(parentPID)
+		if err := n.notify(state...); err != nil {
+			logger.Printf("%+v\n", err)
+		}
+		stopSupervising := n.superviseSingleProcess(logger)
+		defer stopSupervising()
+		if parentPID != 0 {
+			syscall.Kill(parentPID, syscall.SIGTERM)
+			ownSockets(lns)
+		}
+		ln := MultiListener(lns...)
+		defer ln.Close()
+		return serveWorker(w, ln, nil, cfg, logger)
 	}
 
-	lnf, err := ln.(*net.TCPListener).File()
-	if err != nil {
-		return errors.Wrap(err, "error getting file for listener")
-	}
-
-	// FIXME: The worker management is pretty naive right now. It just starts
-	// them all up once and assumes they'll keep running. Eventually, the
-	// manager should kill workers that are running but non-responsive, and
-	// should ensure that the appropriate number of workers are always running.
-	//
-	// It would also be nice if it also supported some of the signals that
-	// gunicorn does for worker management.
-	logger.Println("starting", numWorkers, "workers")
-	wg := &sync.WaitGroup{}
-	wg.Add(numWorkers)
-	env := append([]string{}, os.Environ()...)
-	env = append(env, "PREFORK_WORKER=1")
-	for i := 0; i < numWorkers; i++ {
-		if _, err := execWorker(wg, lnf, env, logger); err != nil {
+	lnfs := make([]*os.File, len(lns))
+	for i, ln := range lns {
+		if lnfs[i], err = listenerFile(ln); err != nil {
+			closeListeners(lns)
 			return err
 		}
 	}
-	wg.Wait()
 
+	m := newManager(cfg, lnfs, logger)
+	m.parentPID = parentPID
+	m.run()
+	if parentPID != 0 && m.parentPID == 0 {
+		// The upgrade finished, so the sockets belong to this manager now.
+		ownSockets(lns)
+	}
+	if m.upgrading == nil {
+		// This removes the Unix sockets this manager created, unless they've
+		// been handed off to a new manager.
+		closeListeners(lns)
+	}
 	return nil
 }
 
 // Run starts the process. It handles either starting the manager or starting
 // the worker, as appropriate, depending on the execution environment.
 //
-// The manager will create a listener on the given address, and launch
+// The manager will create listeners on the configured addresses, and launch
 // subprocesses for the number of workers specified. It runs the workers with
 // the same arguments the original process was passed, and also adds a
 // PREFORK_WORKER environment variable. It uses the presence of that variable
 // to determine that the subprocess should act as a worker.
 //
+// The manager keeps that many workers running for as long as it runs. Workers
+// that exit are restarted (with an increasing delay, if they're crashing
+// repeatedly), and workers that stop sending heartbeats are killed.
+// Workers can ask to be replaced by sending MessageRetire, and the manager
+// stops them gracefully once their replacements are ready.
+//
+// The manager responds to the same signals as gunicorn:
+//
+//	TERM       stop gracefully, waiting up to GracefulTimeout for workers
+//	INT, QUIT  stop immediately
+//	HUP        reload the config, and replace the workers with new ones
+//	TTIN       increase the number of workers by one
+//	TTOU       decrease the number of workers by one
+//	USR1       reopen log files
+//	USR2       upgrade, by starting a new manager with the current binary
+//
+// If the process was started by systemd, the manager uses the socket passed
+// by socket activation instead of creating one, and reports its state with
+// sd_notify: READY=1 once its workers are ready, RELOADING=1 and STOPPING=1
+// in response to signals, and watchdog pings while its workers are sending
+// heartbeats.
+//
+// When upgrading, the new manager inherits the old manager's listeners, so no
+// connections are dropped. Once the new manager's workers are ready, it sends
+// TERM to the old manager, which stops gracefully. If the new manager fails
+// to start, the old manager keeps running. To roll back an upgrade, send TERM
+// to the new manager before its workers are ready.
+//
 // When this function is invoked in a worker, the worker calls w.Serve(...)
 // and passes it a listener.
-func Run(w Worker, addr string, numWorkers int, logger Logger) error {
+func Run(w Worker, cfg Config, logger Logger) error {
 	if os.Getenv("PREFORK_WORKER") != "" {
-		return runWorker(w, logger)
+		return runWorker(w, cfg, logger)
 	}
-	return runManager(w, addr, numWorkers, logger)
+	return runManager(w, cfg, logger)
 }
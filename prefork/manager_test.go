@@ -0,0 +1,544 @@
+package prefork
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/noonat/whiskey/metrics"
+)
+
+// testWorker is run in the worker processes started by the tests. The
+// manager runs workers by re-executing the current binary, so TestMain runs
+// this instead of the tests when it's invoked as a worker. The TEST_WORKER
+// environment variable controls how the worker behaves.
+type testWorker struct {
+	srv      *http.Server
+	pipe     *Pipe
+	requests int64
+	reloads  int64
+}
+
+func (tw *testWorker) Serve(ln net.Listener, logger Logger) error {
+	switch os.Getenv("TEST_WORKER") {
+	case "crash":
+		return errors.New("crashed")
+	case "hang":
+		// Stopping the process stops the heartbeats, too.
+		syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+	}
+	err := tw.srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (tw *testWorker) Shutdown(ctx context.Context) error {
+	return tw.srv.Shutdown(ctx)
+}
+
+// Stats returns the number of requests served. In huge-stats mode, the stats
+// are too large to be sent to the manager.
+func (tw *testWorker) Stats() interface{} {
+	if os.Getenv("TEST_WORKER") == "huge-stats" {
+		return strings.Repeat("x", MaxMessageSize)
+	}
+	return map[string]int64{"requests": atomic.LoadInt64(&tw.requests)}
+}
+
+// Reload counts the times the worker has been reloaded, which requests to
+// /reloads respond with.
+func (tw *testWorker) Reload() error {
+	atomic.AddInt64(&tw.reloads, 1)
+	return nil
+}
+
+// HeapSize reports a heap size of 1000, for the memory limit tests.
+func (tw *testWorker) HeapSize() int64 {
+	return 1000
+}
+
+func (tw *testWorker) SetPipe(p *Pipe) {
+	tw.pipe = p
+}
+
+var testRequests, _ = metrics.Default.NewCounter("test_requests_total", "Requests.")
+
+// ServeHTTP responds with the worker's pid. Requests to /slow take a while to
+// respond, so the tests can stop workers while they're busy. Workers in
+// retire mode ask to be replaced after their first request.
+func (tw *testWorker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if atomic.AddInt64(&tw.requests, 1) == 1 && os.Getenv("TEST_WORKER") == "retire" {
+		tw.pipe.Send(Message{Type: MessageRetire})
+	}
+	testRequests.Inc()
+	if req.URL.Path == "/reloads" {
+		fmt.Fprint(w, atomic.LoadInt64(&tw.reloads))
+		return
+	}
+	if req.URL.Path == "/slow" {
+		d, _ := time.ParseDuration(req.URL.Query().Get("d"))
+		time.Sleep(d)
+	}
+	fmt.Fprint(w, os.Getpid())
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("PREFORK_WORKER") != "" {
+		logger := log.New(ioutil.Discard, "", 0)
+		tw := &testWorker{srv: &http.Server{}}
+		tw.srv.Handler = tw
+		// The worker only needs MetricsAddr to be set to send its metrics;
+		// the manager is the one that serves them.
+		cfg := Config{GracefulTimeout: 10 * time.Second, MetricsAddr: "127.0.0.1:0"}
+		if os.Getenv("TEST_WORKER") == "heap" {
+			// Workers only report their heap size if there's a limit.
+			cfg.HardHeapLimit = 1 << 20
+		}
+		if err := runWorker(tw, cfg, logger); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if mode := os.Getenv("TEST_SYSTEMD"); mode != "" {
+		// This is a manager started by startSystemdManager. systemd sets
+		// LISTEN_PID after it forks, so the manager has to set it here.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		logger := log.New(ioutil.Discard, "", 0)
+		cfg := Config{NumWorkers: 1, GracefulTimeout: 10 * time.Second}
+		tw := &testWorker{}
+		if mode == "single" {
+			// The manager serves requests itself.
+			cfg.NumWorkers = 0
+			tw.srv = &http.Server{Handler: tw}
+		}
+		if err := runManager(tw, cfg, logger); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if os.Getenv(listenFDEnv) != "" {
+		// This is a new manager started by TestManagerUpgrade.
+		logger := log.New(ioutil.Discard, "", 0)
+		cfg := Config{NumWorkers: 1, GracefulTimeout: 10 * time.Second}
+		if err := runManager(&testWorker{}, cfg, logger); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testLogger sends the lines logged by the manager to a channel, so the tests
+// can wait for things to happen.
+type testLogger struct {
+	t     *testing.T
+	lines chan string
+}
+
+func newTestLogger(t *testing.T) *testLogger {
+	return &testLogger{t: t, lines: make(chan string, 1000)}
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	l.t.Log(s)
+	l.lines <- s
+}
+
+func (l *testLogger) Println(args ...interface{}) {
+	s := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	l.t.Log(s)
+	l.lines <- s
+}
+
+func (l *testLogger) SetPrefix(prefix string) {
+}
+
+// waitFor waits for a line matching the regexp to be logged, and returns the
+// submatches from it.
+func (l *testLogger) waitFor(pattern string) []string {
+	re := regexp.MustCompile(pattern)
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case s := <-l.lines:
+			if m := re.FindStringSubmatch(s); m != nil {
+				return m
+			}
+		case <-timer.C:
+			l.t.Fatalf("timed out waiting for %q", pattern)
+		}
+	}
+}
+
+// startTestManager starts a manager with workers running in the given mode.
+// It returns the manager, its logger, the address it's listening on, and a
+// function that stops it and waits for it to return.
+func startTestManager(t *testing.T, mode string, cfg Config) (*manager, *testLogger, string, func()) {
+	os.Setenv("TEST_WORKER", mode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnf, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := newTestLogger(t)
+	m := newManager(cfg, []*os.File{lnf}, logger)
+	done := make(chan struct{})
+	go func() {
+		m.run()
+		close(done)
+	}()
+	return m, logger, ln.Addr().String(), func() {
+		select {
+		case m.signals <- syscall.SIGQUIT:
+		case <-done:
+		}
+		<-done
+		lnf.Close()
+		ln.Close()
+	}
+}
+
+func TestManagerRestartsWorkers(t *testing.T) {
+	_, logger, _, stop := startTestManager(t, "serve", Config{NumWorkers: 2})
+	defer stop()
+
+	pid, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	logger.waitFor(`started worker \d+`)
+	syscall.Kill(pid, syscall.SIGKILL)
+	logger.waitFor(fmt.Sprintf(`worker %d exited unexpectedly`, pid))
+	logger.waitFor(`started worker \d+`)
+}
+
+func TestManagerKillsUnresponsiveWorkers(t *testing.T) {
+	_, logger, _, stop := startTestManager(t, "hang", Config{NumWorkers: 1, Timeout: 500 * time.Millisecond})
+	defer stop()
+
+	pid := logger.waitFor(`started worker (\d+)`)[1]
+	logger.waitFor(fmt.Sprintf(`worker %s hasn't responded in 500ms, killing it`, pid))
+	logger.waitFor(fmt.Sprintf(`worker %s exited unexpectedly`, pid))
+}
+
+func TestManagerKeepsWorkersWithUnsendableStats(t *testing.T) {
+	_, logger, addr, stop := startTestManager(t, "huge-stats", Config{NumWorkers: 1, Timeout: 2 * time.Second})
+	defer stop()
+
+	// The heartbeats keep coming, even though the stats can't be sent.
+	pid, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	time.Sleep(4 * time.Second)
+	if got := get(t, "http://"+addr+"/"); got != pid {
+		t.Errorf("expected a response from worker %d, got %d", pid, got)
+	}
+	for len(logger.lines) > 0 {
+		if s := <-logger.lines; strings.Contains(s, "hasn't responded") {
+			t.Errorf("expected the worker to keep responding, got %q", s)
+		}
+	}
+}
+
+func TestManagerBacksOffCrashingWorkers(t *testing.T) {
+	_, logger, _, stop := startTestManager(t, "crash", Config{NumWorkers: 1})
+	defer stop()
+
+	for _, delay := range []string{"100ms", "200ms", "400ms"} {
+		logger.waitFor(`waiting ` + delay + ` before starting more`)
+	}
+}
+
+// get makes a request to the test workers, and returns the pid of the worker
+// that responded.
+func get(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	pid, _ := strconv.Atoi(string(b))
+	return pid
+}
+
+func TestManagerStopsGracefully(t *testing.T) {
+	m, logger, addr, stop := startTestManager(t, "serve", Config{NumWorkers: 1, GracefulTimeout: 5 * time.Second})
+	defer stop()
+
+	pid, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	if got := get(t, "http://"+addr+"/"); got != pid {
+		t.Fatalf("expected response from worker %d, got %d", pid, got)
+	}
+
+	// The slow request should finish, even though the worker was told to stop
+	// while it was running.
+	result := make(chan int)
+	go func() {
+		result <- get(t, "http://"+addr+"/slow?d=500ms")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	m.signals <- syscall.SIGTERM
+	logger.waitFor(`stopping workers gracefully`)
+	if got := <-result; got != pid {
+		t.Errorf("expected slow response from worker %d, got %d", pid, got)
+	}
+	logger.waitFor(fmt.Sprintf(`worker %d stopped`, pid))
+}
+
+func TestManagerKillsWorkersAfterGracefulTimeout(t *testing.T) {
+	m, logger, addr, stop := startTestManager(t, "serve", Config{NumWorkers: 1, GracefulTimeout: 200 * time.Millisecond})
+	defer stop()
+
+	pid, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	go func() {
+		http.Get("http://" + addr + "/slow?d=10s")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	m.signals <- syscall.SIGTERM
+	logger.waitFor(fmt.Sprintf(`worker %d didn't stop within 200ms, killing it`, pid))
+	logger.waitFor(fmt.Sprintf(`worker %d stopped`, pid))
+}
+
+func TestManagerReload(t *testing.T) {
+	m, logger, _, stop := startTestManager(t, "serve", Config{NumWorkers: 2})
+	defer stop()
+
+	old := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		old[logger.waitFor(`started worker (\d+)`)[1]] = true
+	}
+	m.signals <- syscall.SIGHUP
+	logger.waitFor(`reloading, replacing 2 workers`)
+	for i := 0; i < 2; i++ {
+		if pid := logger.waitFor(`started worker (\d+)`)[1]; old[pid] {
+			t.Fatalf("expected a new worker, got %s", pid)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		pid := logger.waitFor(`worker (\d+) stopped`)[1]
+		if !old[pid] {
+			t.Fatalf("expected an old worker to stop, got %s", pid)
+		}
+		delete(old, pid)
+	}
+}
+
+func TestManagerReloadInPlace(t *testing.T) {
+	m, logger, addr, stop := startTestManager(t, "serve", Config{NumWorkers: 1, ReloadInPlace: true})
+	defer stop()
+
+	// Workers are only told to reload once they're ready.
+	pid, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	ready := func() bool {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return m.workersReady()
+	}
+	for !ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.signals <- syscall.SIGHUP
+	logger.waitFor(`reloading 1 workers in place`)
+	deadline := time.Now().Add(10 * time.Second)
+	for get(t, "http://"+addr+"/reloads") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the worker to reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := get(t, "http://"+addr+"/"); got != pid {
+		t.Errorf("expected a response from worker %d, got %d", pid, got)
+	}
+}
+
+func TestManagerRetire(t *testing.T) {
+	_, logger, addr, stop := startTestManager(t, "retire", Config{NumWorkers: 1})
+	defer stop()
+
+	old := logger.waitFor(`started worker (\d+)`)[1]
+	if got := strconv.Itoa(get(t, "http://"+addr+"/")); got != old {
+		t.Fatalf("expected a response from worker %s, got %s", old, got)
+	}
+
+	// The replacement is started before the old worker is stopped, so
+	// there's always a worker serving requests.
+	logger.waitFor(fmt.Sprintf(`worker %s asked to be replaced`, old))
+	if pid := logger.waitFor(`started worker (\d+)`)[1]; pid == old {
+		t.Fatalf("expected a new worker, got %s", pid)
+	}
+	logger.waitFor(fmt.Sprintf(`stopping worker %s`, old))
+	logger.waitFor(fmt.Sprintf(`worker %s stopped`, old))
+}
+
+func TestManagerMemoryLimits(t *testing.T) {
+	if _, err := processRSS(os.Getpid()); err != nil {
+		t.Skip("can't read resident memory:", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		mode     string
+		cfg      Config
+		expected string
+	}{
+		{"soft rss", "serve", Config{SoftMemoryLimit: 1024}, `is using \d+ bytes of memory, over the soft limit, replacing it`},
+		{"hard rss", "serve", Config{HardMemoryLimit: 1024}, `is using \d+ bytes of memory, over the hard limit, killing it`},
+		{"soft heap", "heap", Config{SoftHeapLimit: 500}, `has a heap size of 1000, over the soft limit, replacing it`},
+		{"hard heap", "heap", Config{HardHeapLimit: 500}, `has a heap size of 1000, over the hard limit, killing it`},
+		{"hard heap and soft rss", "heap", Config{SoftMemoryLimit: 1024, HardHeapLimit: 500}, `has a heap size of 1000, over the hard limit, killing it`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.NumWorkers = 1
+			_, logger, _, stop := startTestManager(t, tc.mode, tc.cfg)
+			defer stop()
+
+			pid := logger.waitFor(`started worker (\d+)`)[1]
+			logger.waitFor(fmt.Sprintf(`worker %s %s`, pid, tc.expected))
+			if next := logger.waitFor(`started worker (\d+)`)[1]; next == pid {
+				t.Fatalf("expected a new worker, got %s", next)
+			}
+		})
+	}
+}
+
+func TestManagerChangesWorkerCount(t *testing.T) {
+	m, logger, _, stop := startTestManager(t, "serve", Config{NumWorkers: 1})
+	defer stop()
+
+	first := logger.waitFor(`started worker (\d+)`)[1]
+	m.signals <- syscall.SIGTTIN
+	logger.waitFor(`increasing worker count to 2`)
+	second := logger.waitFor(`started worker (\d+)`)[1]
+	if second == first {
+		t.Fatalf("expected a second worker to be started")
+	}
+
+	// The oldest worker should be the one that's stopped.
+	m.signals <- syscall.SIGTTOU
+	logger.waitFor(`decreasing worker count to 1`)
+	logger.waitFor(fmt.Sprintf(`worker %s stopped`, first))
+}
+
+func TestManagerUpgrade(t *testing.T) {
+	m, logger, addr, stop := startTestManager(t, "serve", Config{NumWorkers: 1, GracefulTimeout: 5 * time.Second})
+	defer stop()
+
+	old, _ := strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	m.signals <- syscall.SIGUSR2
+	pid, _ := strconv.Atoi(logger.waitFor(`started new manager (\d+)`)[1])
+	defer syscall.Kill(pid, syscall.SIGQUIT)
+
+	// The new manager sends TERM to this process once its worker is ready.
+	logger.waitFor(`stopping workers gracefully`)
+	logger.waitFor(fmt.Sprintf(`worker %d stopped`, old))
+	if got := get(t, "http://"+addr+"/"); got == 0 || got == old {
+		t.Errorf("expected a response from the new manager's worker, got %d", got)
+	}
+}
+
+func TestManagerStatus(t *testing.T) {
+	m, logger, addr, stop := startTestManager(t, "serve", Config{NumWorkers: 2})
+	defer stop()
+
+	logger.waitFor(`started worker \d+`)
+	logger.waitFor(`started worker \d+`)
+	for i := 0; i < 3; i++ {
+		get(t, "http://"+addr+"/")
+	}
+
+	// The stats are sent along with the heartbeats, once a second.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		m.serveStatus(rec, httptest.NewRequest("GET", "/", nil))
+		var s Status
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Workers) != 2 {
+			t.Fatalf("expected 2 workers in status, got %d", len(s.Workers))
+		}
+		if s.Total["requests"] == float64(3) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 requests in total, got %v", s.Total["requests"])
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestManagerMetrics(t *testing.T) {
+	m, logger, addr, stop := startTestManager(t, "serve", Config{NumWorkers: 2, MetricsAddr: "127.0.0.1:0"})
+	defer stop()
+
+	restarts := func(snap metrics.Snapshot) float64 {
+		for _, f := range snap {
+			if f.Name == "prefork_worker_restarts_total" && len(f.Series) > 0 {
+				return f.Series[0].Value
+			}
+		}
+		return 0
+	}
+	before := restarts(m.gatherMetrics())
+
+	var pids [2]int
+	for i := range pids {
+		pids[i], _ = strconv.Atoi(logger.waitFor(`started worker (\d+)`)[1])
+	}
+	for i := 0; i < 3; i++ {
+		get(t, "http://"+addr+"/")
+	}
+
+	requests := func() float64 {
+		for _, f := range m.gatherMetrics() {
+			if f.Name == "test_requests_total" && len(f.Series) > 0 {
+				return f.Series[0].Value
+			}
+		}
+		return 0
+	}
+
+	// The metrics are sent along with the heartbeats, once a second, and
+	// summed across the workers.
+	deadline := time.Now().Add(10 * time.Second)
+	for requests() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 requests in total, got %v", requests())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The counters from workers that have exited are kept.
+	for _, pid := range pids {
+		syscall.Kill(pid, syscall.SIGKILL)
+		logger.waitFor(fmt.Sprintf(`worker %d exited unexpectedly`, pid))
+	}
+	if n := restarts(m.gatherMetrics()); n != before+2 {
+		t.Errorf("expected %v restarts, got %v", before+2, n)
+	}
+	if n := requests(); n != 3 {
+		t.Errorf("expected 3 requests in total after a worker exited, got %v", n)
+	}
+}
@@ -0,0 +1,129 @@
+package prefork
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ProtocolVersion is the version of the message framing used on the pipe
+// between the manager and its workers. It's included in every message, so a
+// mismatched manager and worker (for example, across an upgrade) fail loudly
+// instead of misreading each other.
+const ProtocolVersion = 1
+
+// MaxMessageSize is the largest message body that can be sent on a pipe.
+const MaxMessageSize = 1 << 20
+
+// messageHeaderSize is the size of the header at the start of each message:
+// one byte for the version, one for the type, and four for the body length.
+const messageHeaderSize = 6
+
+// MessageType identifies the kind of message sent on a pipe.
+type MessageType uint8
+
+// These are the messages sent between the manager and its workers.
+const (
+	// MessageHeartbeat is sent by workers once a second to tell the manager
+	// they're still alive.
+	MessageHeartbeat MessageType = iota + 1
+
+	// MessageShutdown is sent by the manager to tell a worker to stop
+	// immediately. Workers send it to the manager when they start stopping.
+	MessageShutdown
+
+	// MessageDrain is sent by the manager to tell a worker to stop gracefully,
+	// finishing its active requests first.
+	MessageDrain
+
+	// MessageStats is sent by workers to report a snapshot of their stats.
+	MessageStats
+
+	// MessageMetrics is sent by workers to report a snapshot of their
+	// metrics registry.
+	MessageMetrics
+
+	// MessageRetire is sent by workers that want to be replaced, such as
+	// after serving a number of requests. The manager starts a new worker,
+	// and tells the old one to drain once the new one is ready.
+	MessageRetire
+
+	// MessageHeap is sent by workers that implement HeapReporter to report
+	// the size of their heap, as a JSON number.
+	MessageHeap
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageHeartbeat:
+		return "heartbeat"
+	case MessageShutdown:
+		return "shutdown"
+	case MessageDrain:
+		return "drain"
+	case MessageStats:
+		return "stats"
+	case MessageMetrics:
+		return "metrics"
+	case MessageRetire:
+		return "retire"
+	case MessageHeap:
+		return "heap"
+	}
+	return "unknown"
+}
+
+// Message is a single message sent on a pipe.
+type Message struct {
+	Type MessageType
+	Body []byte
+}
+
+// Send writes a message to the pipe. It's safe to call from multiple
+// goroutines.
+func (p *Pipe) Send(msg Message) error {
+	if len(msg.Body) > MaxMessageSize {
+		return errors.Errorf("%s message is too large (%d bytes)", msg.Type, len(msg.Body))
+	}
+	b := make([]byte, messageHeaderSize+len(msg.Body))
+	b[0] = ProtocolVersion
+	b[1] = byte(msg.Type)
+	binary.BigEndian.PutUint32(b[2:messageHeaderSize], uint32(len(msg.Body)))
+	copy(b[messageHeaderSize:], msg.Body)
+
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	if _, err := p.WriteFile.Write(b); err != nil {
+		return errors.Wrapf(err, "error sending %s message", msg.Type)
+	}
+	return nil
+}
+
+// Recv reads the next message from the pipe, blocking until one is
+// available. It returns io.EOF once the other end of the pipe has been
+// closed. It shouldn't be called from multiple goroutines.
+func (p *Pipe) Recv() (Message, error) {
+	var h [messageHeaderSize]byte
+	if _, err := io.ReadFull(p.ReadFile, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Message{}, errors.Wrap(err, "error reading message header")
+		}
+		return Message{}, err
+	}
+	if h[0] != ProtocolVersion {
+		return Message{}, errors.Errorf("unsupported protocol version %d", h[0])
+	}
+	msg := Message{Type: MessageType(h[1])}
+	n := binary.BigEndian.Uint32(h[2:])
+	if n > MaxMessageSize {
+		return Message{}, errors.Errorf("%s message is too large (%d bytes)", msg.Type, n)
+	}
+	if n > 0 {
+		msg.Body = make([]byte, n)
+		if _, err := io.ReadFull(p.ReadFile, msg.Body); err != nil {
+			return Message{}, errors.Wrapf(err, "error reading %s message", msg.Type)
+		}
+	}
+	return msg, nil
+}
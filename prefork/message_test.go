@@ -0,0 +1,83 @@
+package prefork
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPipeSendRecv(t *testing.T) {
+	mp, wp, err := NewPipes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	msgs := []Message{
+		{Type: MessageHeartbeat},
+		{Type: MessageStats, Body: []byte(`{"requests":1}`)},
+		{Type: MessageDrain},
+	}
+	go func() {
+		for _, msg := range msgs {
+			if err := wp.Send(msg); err != nil {
+				t.Error(err)
+			}
+		}
+		wp.Close()
+	}()
+
+	for _, expected := range msgs {
+		msg, err := mp.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != expected.Type || !bytes.Equal(msg.Body, expected.Body) {
+			t.Errorf("expected %s message %q, got %s message %q",
+				expected.Type, expected.Body, msg.Type, msg.Body)
+		}
+	}
+	if _, err := mp.Recv(); err != io.EOF {
+		t.Errorf("expected io.EOF after the pipe was closed, got %v", err)
+	}
+}
+
+func TestPipeRecvErrors(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{2, 1, 0, 0, 0, 0}, "unsupported protocol version 2"},
+		{[]byte{1, 4, 0xff, 0, 0, 0}, "stats message is too large"},
+		{[]byte{1, 4, 0, 0, 0, 4, 'a'}, "error reading stats message"},
+		{[]byte{1, 1, 0}, "error reading message header"},
+	}
+	for _, test := range tests {
+		mp, wp, err := NewPipes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wp.Write(test.data)
+		wp.Close()
+		_, err = mp.Recv()
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected error containing %q, got %v", test.expected, err)
+		}
+		mp.Close()
+	}
+}
+
+func TestPipeSendTooLarge(t *testing.T) {
+	mp, wp, err := NewPipes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	defer wp.Close()
+
+	err = wp.Send(Message{Type: MessageStats, Body: make([]byte, MaxMessageSize+1)})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected a too large error, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package prefork
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/noonat/whiskey/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	workerRestarts, _ = metrics.Default.NewCounter("prefork_worker_restarts_total",
+		"Number of times a worker exited unexpectedly and was restarted.")
+	workersGauge, _ = metrics.Default.NewGauge("prefork_workers",
+		"Number of worker processes, by state.", "state")
+)
+
+// gatherMetrics merges the metrics from the manager's own registry with the
+// last snapshots sent by each of the workers, and the counters and histograms
+// of the workers that have exited.
+func (m *manager) gatherMetrics() metrics.Snapshot {
+	m.mutex.Lock()
+	counts := map[string]int{"active": 0, "retiring": 0, "stopping": 0}
+	snaps := []metrics.Snapshot{m.exitedMetrics}
+	for _, w := range m.workers {
+		switch {
+		case w.stopping:
+			counts["stopping"]++
+		case w.retiring:
+			counts["retiring"]++
+		default:
+			counts["active"]++
+		}
+		if snap, ok := m.decodeMetrics(w); ok {
+			snaps = append(snaps, snap)
+		}
+	}
+	m.mutex.Unlock()
+
+	for state, n := range counts {
+		workersGauge.Set(float64(n), state)
+	}
+	return metrics.Merge(append([]metrics.Snapshot{metrics.Default.Snapshot()}, snaps...)...)
+}
+
+// decodeMetrics decodes the last metrics snapshot sent by the worker. It
+// returns false if the worker hasn't sent one, or it couldn't be decoded.
+func (m *manager) decodeMetrics(w *workerProcess) (metrics.Snapshot, bool) {
+	b := w.lastMetrics()
+	if b == nil {
+		return nil, false
+	}
+	var snap metrics.Snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		m.logger.Printf("error decoding metrics from worker %d: %s", w.pid(), err)
+		return nil, false
+	}
+	return snap, true
+}
+
+// serveMetrics serves the snapshots returned by gather on addr, in the
+// Prometheus text format, at /metrics.
+func serveMetrics(addr string, gather func() metrics.Snapshot, logger Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(gather))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Printf("%+v\n", errors.Wrap(err, "error serving metrics"))
+		}
+	}()
+	logger.Println("serving metrics on", addr)
+	return srv
+}
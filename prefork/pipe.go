@@ -2,14 +2,18 @@ package prefork
 
 import (
 	"os"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
-// Pipe is used for bi-directional communication between processes.
+// Pipe is used for bi-directional communication between processes. The
+// manager and its workers exchange messages over it with Send and Recv.
 type Pipe struct {
 	ReadFile  *os.File
 	WriteFile *os.File
+
+	sendMutex sync.Mutex
 }
 
 // NewPipes creates a pair of pipe objects. Data written to one of the pipes
@@ -43,12 +47,12 @@ func (p *Pipe) Close() error {
 	return nil
 }
 
-// Read data from the pipe.
+// Read raw data from the pipe. This shouldn't be mixed with Recv.
 func (p *Pipe) Read(b []byte) (n int, err error) {
 	return p.ReadFile.Read(b)
 }
 
-// Write data to the pipe.
+// Write raw data to the pipe. This shouldn't be mixed with Send.
 func (p *Pipe) Write(b []byte) (n int, err error) {
 	return p.WriteFile.Write(b)
 }
@@ -0,0 +1,171 @@
+package prefork
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status is a snapshot of the manager and its workers.
+type Status struct {
+	PID        int            `json:"pid"`
+	NumWorkers int            `json:"num_workers"`
+	Workers    []WorkerStatus `json:"workers"`
+
+	// Total is the sum of the stats reported by all of the workers.
+	Total map[string]interface{} `json:"total"`
+}
+
+// WorkerStatus is a snapshot of a single worker.
+type WorkerStatus struct {
+	PID           int       `json:"pid"`
+	State         string    `json:"state"`
+	Started       time.Time `json:"started"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+
+	// Stats are the stats last reported by the worker, with its resident
+	// memory added as rss_bytes, and its heap size as heap_size if it
+	// reports one.
+	Stats map[string]interface{} `json:"stats"`
+}
+
+// status returns a snapshot of the manager's workers, oldest first. The
+// caller must hold m.mutex.
+func (m *manager) status() Status {
+	s := Status{
+		PID:        os.Getpid(),
+		NumWorkers: m.cfg.NumWorkers,
+		Workers:    []WorkerStatus{},
+		Total:      map[string]interface{}{},
+	}
+	for _, w := range m.workers {
+		ws := WorkerStatus{
+			PID:           w.pid(),
+			State:         "active",
+			Started:       w.started,
+			LastHeartbeat: w.lastHeartbeat(),
+			Stats:         map[string]interface{}{},
+		}
+		if w.stopping {
+			ws.State = "stopping"
+		} else if w.retiring {
+			ws.State = "retiring"
+		}
+		if b := w.lastStats(); b != nil {
+			if err := json.Unmarshal(b, &ws.Stats); err != nil {
+				m.logger.Printf("error decoding stats from worker %d: %s", ws.PID, err)
+			}
+		}
+		if rss, err := processRSS(ws.PID); err == nil {
+			ws.Stats["rss_bytes"] = float64(rss)
+		}
+		if heap := atomic.LoadInt64(&w.heapSize); heap > 0 {
+			ws.Stats["heap_size"] = float64(heap)
+		}
+		sumStats(s.Total, ws.Stats)
+		s.Workers = append(s.Workers, ws)
+	}
+	sort.Slice(s.Workers, func(i, j int) bool {
+		return s.Workers[i].Started.Before(s.Workers[j].Started)
+	})
+	return s
+}
+
+// serveStatus responds with the manager's status, as JSON.
+func (m *manager) serveStatus(w http.ResponseWriter, req *http.Request) {
+	m.mutex.Lock()
+	s := m.status()
+	m.mutex.Unlock()
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// logStats logs the stats for each worker, and the total across all of them.
+func (m *manager) logStats() {
+	s := m.status()
+	for _, ws := range s.Workers {
+		m.logger.Printf("worker %d (%s): %s", ws.PID, ws.State, formatStats(ws.Stats))
+	}
+	m.logger.Printf("total: %s", formatStats(s.Total))
+}
+
+// sumStats adds the numbers in src to the ones in dst. Nested objects are
+// summed recursively, and other values are ignored.
+func sumStats(dst, src map[string]interface{}) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case float64:
+			n, _ := dst[k].(float64)
+			dst[k] = n + v
+		case map[string]interface{}:
+			d, ok := dst[k].(map[string]interface{})
+			if !ok {
+				d = map[string]interface{}{}
+				dst[k] = d
+			}
+			sumStats(d, v)
+		}
+	}
+}
+
+// formatStats formats stats as a list of key=value pairs, sorted by key.
+// Nested objects are flattened, with their keys joined by dots.
+func formatStats(stats map[string]interface{}) string {
+	var pairs []string
+	var flatten func(prefix string, stats map[string]interface{})
+	flatten = func(prefix string, stats map[string]interface{}) {
+		for k, v := range stats {
+			switch v := v.(type) {
+			case map[string]interface{}:
+				flatten(prefix+k+".", v)
+			case float64:
+				pairs = append(pairs, prefix+k+"="+strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				pairs = append(pairs, fmt.Sprintf("%s%s=%v", prefix, k, v))
+			}
+		}
+	}
+	flatten("", stats)
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// processRSS returns the resident memory of a process, in bytes. It reads it
+// from /proc, so it only works on Linux.
+func processRSS(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading process status")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, errors.Wrap(err, "error parsing VmRSS")
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, errors.Wrap(err, "error reading process status")
+	}
+	return 0, errors.New("VmRSS not found in process status")
+}
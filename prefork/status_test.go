@@ -0,0 +1,52 @@
+package prefork
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSumStats(t *testing.T) {
+	total := map[string]interface{}{}
+	sumStats(total, map[string]interface{}{
+		"requests":     float64(2),
+		"status_codes": map[string]interface{}{"200": float64(2)},
+		"name":         "ignored",
+	})
+	sumStats(total, map[string]interface{}{
+		"requests":     float64(3),
+		"status_codes": map[string]interface{}{"200": float64(1), "500": float64(1)},
+	})
+	expected := map[string]interface{}{
+		"requests":     float64(5),
+		"status_codes": map[string]interface{}{"200": float64(3), "500": float64(1)},
+	}
+	if !reflect.DeepEqual(total, expected) {
+		t.Errorf("expected %v, got %v", expected, total)
+	}
+}
+
+func TestFormatStats(t *testing.T) {
+	s := formatStats(map[string]interface{}{
+		"requests":          float64(5),
+		"pool_wait_seconds": 0.25,
+		"status_codes":      map[string]interface{}{"200": float64(3), "500": float64(1)},
+	})
+	expected := "pool_wait_seconds=0.25 requests=5 status_codes.200=3 status_codes.500=1"
+	if s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestProcessRSS(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("/proc isn't available")
+	}
+	rss, err := processRSS(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss <= 0 {
+		t.Errorf("expected a positive RSS, got %d", rss)
+	}
+}
@@ -0,0 +1,227 @@
+package prefork
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// listenFDsStart is the first file descriptor that systemd passes to a
+// socket activated service. LISTEN_FDS says how many there are, and
+// LISTEN_PID says which process they're meant for.
+const listenFDsStart = 3
+
+// systemdListeners returns the listeners passed to the process by systemd's
+// socket activation, or nil if there aren't any. It unsets the environment
+// variables, so the sockets aren't inherited by the workers a second time.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LISTEN_FDS")
+	}
+
+	var lns []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, errors.Wrapf(err, "error creating listener for systemd socket %d", fd)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// notifier sends notifications about the manager's state to systemd, over
+// the socket in NOTIFY_SOCKET. If it isn't set, the notifications are
+// ignored.
+type notifier struct {
+	addr string
+
+	// watchdog is how often systemd expects a keep-alive ping, from
+	// WATCHDOG_USEC, or 0 if the watchdog isn't enabled. lastPing is the
+	// last time one was sent.
+	watchdog time.Duration
+	lastPing time.Time
+}
+
+// newNotifier creates a notifier from the environment. If the manager was
+// started by an upgrade, parentPID is the old manager, and the new manager
+// takes over its watchdog.
+func newNotifier(parentPID int) *notifier {
+	n := &notifier{addr: os.Getenv("NOTIFY_SOCKET")}
+	if n.addr == "" {
+		return n
+	}
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid, _ := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+	if pid == 0 || pid == os.Getpid() || pid == parentPID {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// notify sends the state to systemd. Each line of the state is a variable
+// assignment, like "READY=1" or "STATUS=serving".
+func (n *notifier) notify(state ...string) error {
+	if n.addr == "" {
+		return nil
+	}
+	// Addresses starting with @ are in the abstract namespace, which the net
+	// package handles for us.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.addr, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "error connecting to systemd")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return errors.Wrap(err, "error notifying systemd")
+	}
+	return nil
+}
+
+// superviseSingleProcess keeps systemd's watchdog fed while the worker runs
+// in the manager's process, and tells systemd that it's stopping once the
+// process is told to stop, or at the latest when the function it returns is
+// called as the worker finishes.
+func (n *notifier) superviseSingleProcess(logger Logger) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer signal.Stop(signals)
+		var ping <-chan time.Time
+		if n.watchdog > 0 {
+			ticker := time.NewTicker(n.watchdog / 2)
+			defer ticker.Stop()
+			ping = ticker.C
+		}
+		notify := func(state ...string) {
+			if err := n.notify(state...); err != nil {
+				logger.Printf("%+v\n", err)
+			}
+		}
+		stopping := false
+		for {
+			select {
+			case <-ping:
+				notify("WATCHDOG=1")
+			case <-signals:
+				// The worker handles the signal itself. This only needs
+				// to tell systemd once.
+				if !stopping {
+					notify("STOPPING=1", "STATUS=stopping")
+					stopping = true
+				}
+			case <-done:
+				// The worker may have stopped before the signal was seen
+				// here, or without one.
+				if !stopping {
+					notify("STOPPING=1", "STATUS=stopping")
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// notify sends the state to systemd, and logs any errors. Nothing is sent
+// once a new manager has replaced this one.
+func (m *manager) notify(state ...string) {
+	if m.replaced {
+		return
+	}
+	if err := m.notifier.notify(state...); err != nil {
+		m.logger.Printf("%+v\n", err)
+	}
+}
+
+// notifyReady tells systemd that the manager is ready, once all of its
+// workers are ready and none are being replaced. It's sent after the
+// manager first starts, and after each reload. If this manager is replacing
+// an old one, it tells systemd to track it as the main process instead.
+func (m *manager) notifyReady() {
+	if m.ready || m.stopping || !m.workersReady() {
+		return
+	}
+	for _, w := range m.workers {
+		if w.retiring {
+			return
+		}
+	}
+	state := []string{"READY=1", "STATUS=" + m.statusLine()}
+	if m.parentPID != 0 {
+		state = append(state, "MAINPID="+strconv.Itoa(os.Getpid()))
+	}
+	m.notify(state...)
+	m.ready = true
+	m.started = true
+}
+
+// notifyReloading tells systemd that the manager is reloading. It's ready
+// again once the new workers are.
+func (m *manager) notifyReloading() {
+	m.notify("RELOADING=1", "STATUS=reloading",
+		"MONOTONIC_USEC="+strconv.FormatInt(monotonicNow()/int64(time.Microsecond), 10))
+	m.ready = false
+}
+
+// notifyStopping tells systemd that the manager is stopping.
+func (m *manager) notifyStopping() {
+	m.notify("STOPPING=1", "STATUS=stopping")
+	m.ready = false
+}
+
+// pingWatchdog sends a keep-alive ping to systemd's watchdog, if it's
+// enabled. Once the manager has started, it only pings while at least one
+// worker has sent a heartbeat within the watchdog interval, so systemd
+// restarts the service if all of its workers are stuck.
+func (m *manager) pingWatchdog() {
+	n := m.notifier
+	if n.watchdog <= 0 || time.Since(n.lastPing) < n.watchdog/2 {
+		return
+	}
+	if m.started {
+		healthy := false
+		for _, w := range m.activeWorkers() {
+			if time.Since(w.lastHeartbeat()) < n.watchdog {
+				healthy = true
+				break
+			}
+		}
+		if !healthy {
+			return
+		}
+	}
+	m.notify("WATCHDOG=1")
+	n.lastPing = time.Now()
+}
+
+// statusLine describes the manager's workers, for systemd's STATUS.
+func (m *manager) statusLine() string {
+	return "serving with " + strconv.Itoa(len(m.activeWorkers())) + " workers"
+}
@@ -0,0 +1,17 @@
+package prefork
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// clockMonotonic is CLOCK_MONOTONIC, which systemd uses for MONOTONIC_USEC.
+const clockMonotonic = 1
+
+// monotonicNow returns the current time of the monotonic clock, in
+// nanoseconds.
+func monotonicNow() int64 {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	return ts.Nano()
+}
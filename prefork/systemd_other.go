@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package prefork
+
+// monotonicNow returns 0, as systemd only runs on Linux.
+func monotonicNow() int64 {
+	return 0
+}
@@ -0,0 +1,204 @@
+package prefork
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenNotify creates a fake systemd notify socket.
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// waitForNotify reads notifications from the socket until it gets one that
+// contains the line, and returns the whole notification.
+func waitForNotify(t *testing.T, conn *net.UnixConn, line string) string {
+	b := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("error waiting for %q: %s", line, err)
+		}
+		s := string(b[:n])
+		for _, l := range strings.Split(s, "\n") {
+			if l == line {
+				return s
+			}
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	name := fmt.Sprintf("@prefork-test-%d", os.Getpid())
+	conn := listenNotify(t, name)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", name)
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	os.Setenv("WATCHDOG_PID", "1")
+	n := newNotifier(0)
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if n.watchdog != 0 {
+		t.Errorf("expected the watchdog to be disabled for another pid, got %s", n.watchdog)
+	}
+
+	if err := n.notify("READY=1", "STATUS=testing"); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitForNotify(t, conn, "READY=1"); s != "READY=1\nSTATUS=testing" {
+		t.Errorf("unexpected notification %q", s)
+	}
+
+	// Without NOTIFY_SOCKET, notifications are ignored.
+	if err := newNotifier(0).notify("READY=1"); err != nil {
+		t.Error(err)
+	}
+}
+
+// startSystemdManager starts a manager in a new process, the way systemd
+// would, with a socket and a fake notify socket. mode is passed to the test
+// process in TEST_SYSTEMD. It returns the manager's process, the notify
+// socket, the socket's address, and a function that cleans up.
+func startSystemdManager(t *testing.T, mode string) (*exec.Cmd, *net.UnixConn, string, func()) {
+	dir, err := ioutil.TempDir("", "prefork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifySocket := filepath.Join(dir, "notify")
+	conn := listenNotify(t, notifySocket)
+
+	// This is the socket systemd would pass to the service.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	lnf, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "TEST_SYSTEMD="+mode, "TEST_WORKER=serve",
+		"LISTEN_FDS=1", "NOTIFY_SOCKET="+notifySocket, "WATCHDOG_USEC=500000")
+	cmd.ExtraFiles = []*os.File{lnf}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lnf.Close()
+	return cmd, conn, addr, func() {
+		cmd.Process.Kill()
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestManagerSystemd(t *testing.T) {
+	cmd, conn, addr, stop := startSystemdManager(t, "workers")
+	defer stop()
+
+	waitForNotify(t, conn, "STATUS=starting 1 workers")
+	s := waitForNotify(t, conn, "READY=1")
+	if !strings.Contains(s, "STATUS=serving with 1 workers") {
+		t.Errorf("expected status with READY=1, got %q", s)
+	}
+	waitForNotify(t, conn, "WATCHDOG=1")
+	if pid := get(t, "http://"+addr+"/"); pid == 0 || pid == cmd.Process.Pid {
+		t.Errorf("expected a response from a worker, got %d", pid)
+	}
+
+	cmd.Process.Signal(syscall.SIGHUP)
+	s = waitForNotify(t, conn, "RELOADING=1")
+	if !strings.Contains(s, "MONOTONIC_USEC=") {
+		t.Errorf("expected MONOTONIC_USEC with RELOADING=1, got %q", s)
+	}
+	waitForNotify(t, conn, "READY=1")
+
+	// After an upgrade, the new manager tells systemd that it's the main
+	// process, and then stops the old one, which mustn't tell systemd that
+	// it's stopping.
+	cmd.Process.Signal(syscall.SIGUSR2)
+	s = waitForNotify(t, conn, "READY=1")
+	var pid int
+	for _, l := range strings.Split(s, "\n") {
+		if strings.HasPrefix(l, "MAINPID=") {
+			pid, _ = strconv.Atoi(strings.TrimPrefix(l, "MAINPID="))
+		}
+	}
+	if pid == 0 || pid == cmd.Process.Pid {
+		t.Fatalf("expected MAINPID for the new manager with READY=1, got %q", s)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	b := make([]byte, 4096)
+	deadline := time.Now().Add(10 * time.Second)
+	for stopped := false; time.Now().Before(deadline); {
+		select {
+		case err := <-exited:
+			if err != nil {
+				t.Errorf("expected the old manager to exit cleanly, got %s", err)
+			}
+			// Anything it sent is already queued on the socket.
+			stopped = true
+			deadline = time.Now().Add(300 * time.Millisecond)
+		default:
+			if !stopped && time.Now().Add(100*time.Millisecond).After(deadline) {
+				t.Fatal("timed out waiting for the old manager to exit")
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(b)
+		if err == nil && strings.Contains(string(b[:n]), "STOPPING=1") {
+			t.Fatalf("expected the old manager not to send STOPPING=1, got %q", b[:n])
+		}
+	}
+
+	// The new manager isn't this process's child, so poll for it to exit.
+	syscall.Kill(pid, syscall.SIGTERM)
+	waitForNotify(t, conn, "STOPPING=1")
+	for deadline := time.Now().Add(10 * time.Second); syscall.Kill(pid, 0) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the new manager to exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSingleProcessSystemd(t *testing.T) {
+	cmd, conn, addr, stop := startSystemdManager(t, "single")
+	defer stop()
+
+	s := waitForNotify(t, conn, "READY=1")
+	if !strings.Contains(s, "STATUS=serving in single process mode") {
+		t.Errorf("expected status with READY=1, got %q", s)
+	}
+	waitForNotify(t, conn, "WATCHDOG=1")
+	if pid := get(t, "http://"+addr+"/"); pid != cmd.Process.Pid {
+		t.Errorf("expected a response from the manager %d, got %d", cmd.Process.Pid, pid)
+	}
+	waitForNotify(t, conn, "WATCHDOG=1")
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	waitForNotify(t, conn, "STOPPING=1")
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("expected the manager to exit cleanly, got %s", err)
+	}
+}
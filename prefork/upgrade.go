@@ -0,0 +1,113 @@
+package prefork
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// These environment variables are passed from an old manager to the new
+// manager that's replacing it during an upgrade. PREFORK_LISTEN_FD is a comma
+// separated list of the file descriptors of the inherited listeners, and
+// PREFORK_PARENT_PID is the old manager, which is told to stop once the new
+// manager's workers are ready.
+const (
+	listenFDEnv  = "PREFORK_LISTEN_FD"
+	parentPIDEnv = "PREFORK_PARENT_PID"
+)
+
+// inheritListeners returns the listeners passed to the manager by the old
+// manager it's replacing, and the old manager's pid.
+func inheritListeners(logger Logger) ([]net.Listener, int, error) {
+	// These shouldn't be passed on to the workers, or to the next upgrade.
+	fds := strings.Split(os.Getenv(listenFDEnv), ",")
+	parentPID, _ := strconv.Atoi(os.Getenv(parentPIDEnv))
+	os.Unsetenv(listenFDEnv)
+	os.Unsetenv(parentPIDEnv)
+
+	var lns []net.Listener
+	for _, s := range fds {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			closeListeners(lns)
+			return nil, 0, errors.Wrapf(err, "invalid %s", listenFDEnv)
+		}
+		f := os.NewFile(uintptr(fd), "")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(lns)
+			return nil, 0, errors.Wrap(err, "error creating inherited listener")
+		}
+		logger.Println("inherited listener on", formatAddr(ln.Addr()))
+		lns = append(lns, ln)
+	}
+	return lns, parentPID, nil
+}
+
+// upgrade starts a new manager, using the current binary and arguments, and
+// hands it the listener. The new manager stops this one once its workers are
+// ready. If the new manager fails to start, this one keeps running.
+func (m *manager) upgrade() {
+	if m.stopping {
+		return
+	}
+	if m.upgrading != nil {
+		m.logger.Printf("already upgrading to manager %d", m.upgrading.Process.Pid)
+		return
+	}
+
+	fds := make([]string, len(m.lnfs))
+	for i := range m.lnfs {
+		fds[i] = strconv.Itoa(3 + i)
+	}
+	env := append([]string{}, os.Environ()...)
+	env = append(env, listenFDEnv+"="+strings.Join(fds, ","),
+		parentPIDEnv+"="+strconv.Itoa(os.Getpid()))
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = env
+	cmd.ExtraFiles = m.lnfs
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		m.logger.Printf("%+v\n", errors.Wrap(err, "error starting new manager"))
+		return
+	}
+	m.logger.Printf("upgrading, started new manager %d", cmd.Process.Pid)
+	m.upgrading = cmd
+	go func() {
+		cmd.Wait()
+		m.upgradeExited <- cmd
+	}()
+}
+
+// handleUpgradeExit is called when a new manager started by upgrade exits.
+// Normally this manager has already been told to stop by then.
+func (m *manager) handleUpgradeExit(cmd *exec.Cmd) {
+	if m.upgrading == cmd {
+		m.upgrading = nil
+	}
+	if !m.stopping {
+		m.logger.Printf("upgrade failed, new manager %d exited: %s",
+			cmd.Process.Pid, cmd.ProcessState)
+	}
+}
+
+// finishUpgrade tells the old manager to stop gracefully, once this
+// manager's workers are ready to serve requests.
+func (m *manager) finishUpgrade() {
+	if m.parentPID == 0 || !m.workersReady() {
+		return
+	}
+	m.logger.Printf("workers are ready, stopping old manager %d", m.parentPID)
+	if err := syscall.Kill(m.parentPID, syscall.SIGTERM); err != nil {
+		m.logger.Printf("error stopping old manager %d: %s", m.parentPID, err)
+	}
+	m.parentPID = 0
+}
@@ -1,40 +1,115 @@
 package prefork
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/noonat/whiskey/metrics"
 	"github.com/pkg/errors"
 )
 
-// These file descriptors are passed from the master to the worker.
+// These file descriptors are passed from the master to the worker. If there's
+// more than one listener, the rest start at extraListenFD, and the number of
+// listeners is passed in PREFORK_LISTENERS.
 const (
 	listenFD          = uintptr(3)
 	workerPipeReadFD  = uintptr(4)
 	workerPipeWriteFD = uintptr(5)
+	extraListenFD     = uintptr(6)
+	numListenersEnv   = "PREFORK_LISTENERS"
 )
 
 // Worker is the interface that workers must implement. The master creates the
-// listening TCP socket, and it's passed into each of the workers so they can
-// all call Accept() on it.
+// listening sockets, and they're passed into each of the workers so they can
+// all call Accept() on them. If there's more than one, the worker is given a
+// listener that accepts connections from all of them.
 //
 // Serve should block indefinitely and return when the worker should terminate.
+//
+// Shutdown is called when the worker is asked to stop gracefully. It should
+// stop accepting new connections and return once the active ones have
+// finished, or when the context is done. Serve may return as soon as
+// Shutdown is called; the worker process waits for Shutdown to return before
+// it exits.
 type Worker interface {
 	Serve(ln net.Listener, logger Logger) error
+	Shutdown(ctx context.Context) error
+}
+
+// LogReopener can be implemented by workers and loggers that write to log
+// files. ReopenLogs is called when the process receives SIGUSR1, so the files
+// can be rotated.
+type LogReopener interface {
+	ReopenLogs() error
+}
+
+// StatsReporter can be implemented by workers to report stats to the
+// manager. Stats is called once a second, and its result is encoded as JSON
+// and sent to the manager, which sums the numeric fields across all of the
+// workers. It should return a struct or map, so it's encoded as an object.
+type StatsReporter interface {
+	Stats() interface{}
+}
+
+// HeapReporter can be implemented by workers that can report the size of
+// their heap, in whatever unit their runtime counts it, such as the number
+// of blocks Python has allocated. HeapSize is called once a second if the
+// config has a heap limit, and the manager replaces or kills workers that
+// go over it.
+type HeapReporter interface {
+	HeapSize() int64
 }
 
-func runWorker(w Worker, logger Logger) error {
+// Reloader can be implemented by workers that can reload some of their
+// config, like TLS certificates, without being replaced. Reload is called
+// when the worker receives SIGHUP.
+type Reloader interface {
+	Reload() error
+}
+
+// PipeSetter can be implemented by workers that want to send their own
+// messages to the manager. SetPipe is called with the pipe to the manager
+// before Serve. Workers should only call Send on it; the pipe is read by the
+// prefork package.
+type PipeSetter interface {
+	SetPipe(p *Pipe)
+}
+
+func runWorker(w Worker, cfg Config, logger Logger) error {
 	logger.SetPrefix(fmt.Sprintf("worker\t[%d]\t", os.Getpid()))
 
-	// Recreate the TCP listener from the inherited files
-	lnf := os.NewFile(listenFD, "")
-	ln, err := net.FileListener(lnf)
-	if err != nil {
-		return errors.Wrap(err, "error creating net.FileListener")
+	// Recreate the listeners from the inherited files
+	n := 1
+	if s := os.Getenv(numListenersEnv); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			return errors.Wrapf(err, "invalid %s", numListenersEnv)
+		}
 	}
+	lns := make([]net.Listener, n)
+	for i := range lns {
+		fd := listenFD
+		if i > 0 {
+			fd = extraListenFD + uintptr(i-1)
+		}
+		lnf := os.NewFile(fd, "")
+		ln, err := net.FileListener(lnf)
+		lnf.Close()
+		if err != nil {
+			return errors.Wrap(err, "error creating net.FileListener")
+		}
+		lns[i] = ln
+	}
+	ln := MultiListener(lns...)
 
 	// Recreate the internal communication pipe from the inherited files
 	wp := &Pipe{
@@ -43,44 +118,196 @@ func runWorker(w Worker, logger Logger) error {
 	}
 	defer wp.Close()
 
-	// Shutdown on SIGINT or when the done channel is closed
-	closed := false
+	logger.Println("started worker")
+	return serveWorker(w, ln, wp, cfg, logger)
+}
+
+// serveWorker runs the worker on the listener until it's told to stop, either
+// by a signal or by the manager going away. wp is the pipe to the manager,
+// and may be nil if the worker is running in the manager's process.
+//
+// SIGTERM stops the worker gracefully, giving active connections up to
+// cfg.GracefulTimeout to finish. SIGINT and SIGQUIT stop it immediately.
+// SIGUSR1 reopens log files, and SIGHUP reloads the worker if it's a
+// Reloader.
+func serveWorker(w Worker, ln net.Listener, wp *Pipe, cfg Config, logger Logger) error {
+	// done is closed when the worker starts stopping, and drained is closed
+	// once a graceful shutdown has finished (or been cut short).
 	done := make(chan struct{})
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	go func() {
+	drained := make(chan struct{})
+	stopOnce := &sync.Once{}
+	drainOnce := &sync.Once{}
+	graceful := false
+	stop := func(fast bool) {
+		stopOnce.Do(func() {
+			graceful = !fast
+			close(done)
+			if wp != nil {
+				wp.Send(Message{Type: MessageShutdown})
+			}
+			if fast {
+				return
+			}
+			go func() {
+				ctx := context.Background()
+				if cfg.GracefulTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, cfg.GracefulTimeout)
+					defer cancel()
+				}
+				if err := w.Shutdown(ctx); err != nil {
+					logger.Println("error shutting down gracefully:", err)
+				}
+				ln.Close()
+				drainOnce.Do(func() { close(drained) })
+			}()
+		})
+		if fast {
+			// A fast stop cuts short a graceful one that's in progress.
+			drainOnce.Do(func() { close(drained) })
+			ln.Close()
+		}
+	}
+	closed := func() bool {
 		select {
 		case <-done:
-		case <-interrupt:
-			close(done)
+			return true
+		default:
+			return false
 		}
-		signal.Stop(interrupt)
-		closed = true
-		wp.Write([]byte{0})
-		ln.Close()
-	}()
+	}
 
-	// Send a keepalive to the master
-	t := time.NewTicker(time.Second)
-	defer t.Stop()
+	signals := make(chan os.Signal, 10)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT,
+		syscall.SIGTERM, syscall.SIGUSR1)
+	defer signal.Stop(signals)
 	go func() {
-		b := []byte{1}
-		var err error
-		for range t.C {
-			_, err = wp.Write(b)
-			if err != nil {
-				break
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGTERM:
+				logger.Println("stopping gracefully")
+				stop(false)
+			case syscall.SIGINT, syscall.SIGQUIT:
+				logger.Println("stopping")
+				stop(true)
+			case syscall.SIGUSR1:
+				reopenLogs(w, logger)
+			case syscall.SIGHUP:
+				reloadWorker(w, logger)
 			}
 		}
-		if !closed && err != nil {
-			logger.Println("error writing keepalive:", err)
-		}
 	}()
 
-	logger.Println("started worker")
-	if err := w.Serve(ln, logger); !closed && err != nil {
-		return err
+	if wp != nil {
+		if ps, ok := w.(PipeSetter); ok {
+			ps.SetPipe(wp)
+		}
+
+		// Handle commands from the manager. If the manager goes away, the
+		// worker stops too.
+		go func() {
+			for {
+				msg, err := wp.Recv()
+				if err != nil {
+					if !closed() {
+						if err != io.EOF {
+							logger.Println("error reading from manager:", err)
+						}
+						logger.Println("lost connection to manager, stopping")
+						stop(true)
+					}
+					return
+				}
+				switch msg.Type {
+				case MessageDrain:
+					logger.Println("stopping gracefully")
+					stop(false)
+				case MessageShutdown:
+					logger.Println("stopping")
+					stop(true)
+				default:
+					logger.Printf("unexpected %s message from manager", msg.Type)
+				}
+			}
+		}()
+
+		// Send a heartbeat to the manager, along with the worker's stats
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		sr, _ := w.(StatsReporter)
+		hr, _ := w.(HeapReporter)
+		if cfg.SoftHeapLimit <= 0 && cfg.HardHeapLimit <= 0 {
+			hr = nil
+		}
+		go func() {
+			// Reports that can't be sent, like a metrics snapshot that's
+			// grown too large for a message, are skipped, so that they
+			// don't stop the heartbeats and get a healthy worker killed.
+			// Each failure is only logged until the report is sent again.
+			failing := map[MessageType]bool{}
+			report := func(typ MessageType, v interface{}) {
+				err := sendJSON(wp, typ, v)
+				if err != nil && !failing[typ] && !closed() {
+					logger.Printf("error sending %s, skipping it: %s", typ, err)
+				}
+				failing[typ] = err != nil
+			}
+			for range t.C {
+				if err := wp.Send(Message{Type: MessageHeartbeat}); err != nil {
+					if !closed() {
+						logger.Println("error sending heartbeat:", err)
+					}
+					return
+				}
+				if sr != nil {
+					report(MessageStats, sr.Stats())
+				}
+				if hr != nil {
+					report(MessageHeap, hr.HeapSize())
+				}
+				if cfg.MetricsAddr != "" {
+					report(MessageMetrics, metrics.Default.Snapshot())
+				}
+			}
+		}()
 	}
 
+	if err := w.Serve(ln, logger); !closed() && err != nil {
+		return err
+	}
+	if graceful {
+		<-drained
+	}
 	return nil
 }
+
+// sendJSON encodes v as JSON and sends it to the manager.
+func sendJSON(wp *Pipe, typ MessageType, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding %s", typ)
+	}
+	return wp.Send(Message{Type: typ, Body: b})
+}
+
+// reloadWorker reloads the worker's config, if it's a Reloader.
+func reloadWorker(w Worker, logger Logger) {
+	if r, ok := w.(Reloader); ok {
+		logger.Println("reloading")
+		if err := r.Reload(); err != nil {
+			logger.Println("error reloading:", err)
+		}
+	}
+}
+
+// reopenLogs reopens the log files for the worker and logger, if they have
+// any.
+func reopenLogs(w Worker, logger Logger) {
+	for _, v := range []interface{}{w, logger} {
+		if r, ok := v.(LogReopener); ok {
+			if err := r.ReopenLogs(); err != nil {
+				logger.Println("error reopening logs:", err)
+			}
+		}
+	}
+}
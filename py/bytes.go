@@ -0,0 +1,45 @@
+package py
+
+/*
+#include "whiskey_py.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Bytes wraps a Python byte string. On Python 2, this is the same type as
+// String.
+type Bytes struct {
+	Object
+}
+
+// NewBytes converts a Go byte slice to a Python byte string.
+func NewBytes(b []byte) (Bytes, error) {
+	var pb Bytes
+	var cs *C.char
+	if len(b) > 0 {
+		cs = (*C.char)(unsafe.Pointer(&b[0]))
+	}
+	// PyBytes_FromStringAndSize copies the data, so it's safe to pass it a
+	// pointer to the Go slice here.
+	pb.PyObject = C.PyBytes_FromStringAndSize(cs, C.Py_ssize_t(len(b)))
+	if pb.PyObject == nil {
+		return pb, errors.Wrap(GetError(), "error converting to Python bytes")
+	}
+	return pb, nil
+}
+
+// GoBytes copies the Python byte string into a Go byte slice.
+func (pb Bytes) GoBytes() []byte {
+	cs := C.PyBytes_AsString(pb.PyObject)
+	return C.GoBytes(unsafe.Pointer(cs), C.int(C.PyBytes_Size(pb.PyObject)))
+}
+
+// Len returns the size of the Python byte string.
+func (pb Bytes) Len() int {
+	return int(C.PyBytes_Size(pb.PyObject))
+}
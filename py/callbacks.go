@@ -16,6 +16,9 @@ var callbacks = map[string]CallbackFunc{}
 // Whiskey Python module. This provides a way to easily invoke Go functions
 // from Python without needing to create exported cgo functions and Python
 // wrappers for each one.
+//
+// If the callback returns an error, it's raised as an exception in Python.
+// Return an Exception to control the type of exception that's raised.
 func RegisterCallback(name string, fn CallbackFunc) {
 	callbacks[name] = fn
 }
@@ -31,9 +34,8 @@ func whiskeyCall(name *C.char, args *C.PyObject) *C.PyObject {
 	}
 	result, err := fn(Tuple{Object{args}})
 	if err != nil {
-		log.Printf("error: whiskey_call for %q failed: %+v\n", k, err)
-		None.IncRef()
-		return None.PyObject
+		SetError(err)
+		return nil
 	}
 	return result.PyObject
 }
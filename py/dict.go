@@ -53,6 +53,7 @@ func (d Dict) SetItemInt(k Object, i int) error {
 	if err != nil {
 		return err
 	}
+	defer v.DecRef()
 	return d.SetItem(k, v.Object)
 }
 
@@ -63,5 +64,6 @@ func (d Dict) SetItemString(k Object, s string) error {
 	if err != nil {
 		return err
 	}
+	defer v.DecRef()
 	return d.SetItem(k, v.Object)
 }
@@ -5,7 +5,80 @@ package py
 */
 import "C"
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Exception is an error that represents a Python exception. When a callback
+// returns an Exception as its error, the exception is raised in Python,
+// instead of the generic RuntimeError used for other errors.
+type Exception struct {
+	typ, val, tb Object
+	message      string
+}
+
+// NewException creates an Exception with the given type (e.g. AssertionError)
+// and message.
+func NewException(typ Object, message string) *Exception {
+	typ.IncRef()
+	return &Exception{typ: typ, message: message}
+}
+
+// NewExceptionInfo creates an Exception from a (type, value, traceback)
+// tuple, like the ones returned by sys.exc_info(). This can be used to
+// re-raise an exception that was caught in Python.
+func NewExceptionInfo(excInfo Tuple) (*Exception, error) {
+	e := &Exception{message: "re-raised exception"}
+	if err := excInfo.GetItems(&e.typ, &e.val, &e.tb); err != nil {
+		e.typ.DecRef()
+		e.val.DecRef()
+		e.tb.DecRef()
+		return nil, err
+	}
+	if e.tb == None {
+		e.tb.DecRef()
+		e.tb.PyObject = nil
+	}
+	return e, nil
+}
+
+func (e *Exception) Error() string {
+	return e.message
+}
+
+// Restore sets the exception as the current Python exception. This steals the
+// Exception's references, so it can only be called once.
+func (e *Exception) Restore() {
+	if e.typ.PyObject == nil {
+		return
+	}
+	if e.val.PyObject == nil {
+		cs := C.CString(e.message)
+		C.PyErr_SetString(e.typ.PyObject, cs)
+		C.free(unsafe.Pointer(cs))
+		e.typ.DecRef()
+	} else {
+		C.PyErr_Restore(e.typ.PyObject, e.val.PyObject, e.tb.PyObject)
+	}
+	e.typ.PyObject = nil
+	e.val.PyObject = nil
+	e.tb.PyObject = nil
+}
+
+// SetError sets err as the current Python exception. If err is an Exception,
+// it's raised as is. Otherwise, it's converted to a RuntimeError.
+func SetError(err error) {
+	if e, ok := errors.Cause(err).(*Exception); ok {
+		e.Restore()
+		return
+	}
+	cs := C.CString(fmt.Sprintf("%+v", err))
+	C.PyErr_SetString(RuntimeError.PyObject, cs)
+	C.free(unsafe.Pointer(cs))
+}
 
 var gettingError = false
 
@@ -37,6 +110,9 @@ func GetError() error {
 	if typ.PyObject == nil {
 		return nil
 	}
+	// Exceptions raised by C code may not have been instantiated yet, and
+	// the traceback module needs an exception instance.
+	C.PyErr_NormalizeException(&typ.PyObject, &val.PyObject, &tb.PyObject)
 
 	m, err := ImportModule("traceback")
 	if err != nil {
@@ -0,0 +1,30 @@
+package py
+
+/*
+#include "whiskey_py.h"
+*/
+import "C"
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Float wraps a Python float.
+type Float struct {
+	Object
+}
+
+// NewFloat converts a Go float64 into a Python Float.
+func NewFloat(f float64) (Float, error) {
+	var pf Float
+	pf.PyObject = C.PyFloat_FromDouble(C.double(f))
+	if pf.PyObject == nil {
+		return pf, errors.Wrap(GetError(), "error converting to Python float")
+	}
+	return pf, nil
+}
+
+// GoFloat64 converts the Python float into a Go float64.
+func (pf Float) GoFloat64() (float64, error) {
+	return pf.Object.GoFloat64()
+}
@@ -9,7 +9,8 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Int wraps a Python integer.
+// Int wraps a Python integer. This is a PyLong on Python 3, and a PyInt on
+// Python 2.
 type Int struct {
 	Object
 }
@@ -17,7 +18,7 @@ type Int struct {
 // NewInt converts a Go int into a Python Int.
 func NewInt(n int) (Int, error) {
 	var pn Int
-	pn.PyObject = C.PyInt_FromLong(C.long(n))
+	pn.PyObject = C.whiskey_int_from_long(C.long(n))
 	if pn.PyObject == nil {
 		return pn, errors.Wrap(GetError(), "error converting to Python int")
 	}
@@ -26,7 +27,7 @@ func NewInt(n int) (Int, error) {
 
 // GoInt converts the Python int into a Go int.
 func (pn Int) GoInt() (int, error) {
-	n := C.PyInt_AsLong(pn.PyObject)
+	n := C.whiskey_int_as_long(pn.PyObject)
 	if n == -1 && C.PyErr_Occurred() != nil {
 		return 0, errors.Wrap(GetError(), "error converting to Go int")
 	}
@@ -24,7 +24,7 @@ func NewModuleString(name, src string) (Object, error) {
 
 	cs := C.CString(src)
 	cfn := C.CString(fmt.Sprintf("<string src for %s>", name))
-	co := C.Py_CompileStringFlags(cs, cfn, C.Py_file_input, nil)
+	co := C.whiskey_compile_string(cs, cfn)
 	C.free(unsafe.Pointer(cs))
 	C.free(unsafe.Pointer(cfn))
 	if co == nil {
@@ -86,6 +86,13 @@ func (o Object) Call(args ...Object) (Object, error) {
 // returns a new reference, not a borrowed one.
 func (o Object) ConvertInto(ptr interface{}) error {
 	switch t := ptr.(type) {
+	case *Bytes:
+		pb, err := o.Bytes()
+		if err != nil {
+			return err
+		}
+		pb.IncRef()
+		*t = pb
 	case *List:
 		pl, err := o.List()
 		if err != nil {
@@ -103,6 +110,18 @@ func (o Object) ConvertInto(ptr interface{}) error {
 		}
 		ps.IncRef()
 		*t = ps
+	case *[]byte:
+		pb, err := o.Bytes()
+		if err != nil {
+			return err
+		}
+		*t = pb.GoBytes()
+	case *float64:
+		f, err := o.GoFloat64()
+		if err != nil {
+			return err
+		}
+		*t = f
 	case *int:
 		n, err := o.GoInt()
 		if err != nil {
@@ -136,6 +155,28 @@ func (o Object) IncRef() {
 	}
 }
 
+// Bytes wraps the object in a Bytes struct.
+// The underlying type must be a Python byte string or an error will be
+// returned.
+func (o Object) Bytes() (Bytes, error) {
+	b := Bytes{o}
+	if C.whiskey_check_bytes(o.PyObject) == 0 {
+		return b, errors.New("object is not a byte string")
+	}
+	return b, nil
+}
+
+// GoFloat64 converts the object into a Go float64.
+// The underlying type must be a Python float, or a type that can be converted
+// to one (like an int), or an error will be returned.
+func (o Object) GoFloat64() (float64, error) {
+	f := C.PyFloat_AsDouble(o.PyObject)
+	if f == -1 && C.PyErr_Occurred() != nil {
+		return 0, errors.Wrap(GetError(), "error converting to Go float64")
+	}
+	return float64(f), nil
+}
+
 // GoInt converts the object into a Go int.
 // The underlying type must be a Python int or an error will be returned.
 func (o Object) GoInt() (int, error) {
@@ -209,6 +250,14 @@ func (o Object) GetAttrString(attr string) (Object, error) {
 	return v, nil
 }
 
+// HasAttrString returns true if the object has the given attribute.
+// It's the equivalent of calling hasattr(o, attr) in Python.
+func (o Object) HasAttrString(attr string) bool {
+	cs := C.CString(attr)
+	defer C.free(unsafe.Pointer(cs))
+	return C.PyObject_HasAttrString(o.PyObject, cs) != 0
+}
+
 // IsCallable returns true if the underlying Python object is callable.
 func (o Object) IsCallable() bool {
 	return C.PyCallable_Check(o.PyObject) != 0
@@ -220,7 +269,7 @@ func (o Object) Iter() (Iter, error) {
 	var it Iter
 	it.PyObject = C.PyObject_GetIter(o.PyObject)
 	if it.PyObject == nil {
-		return it, errors.New("error getting iterator")
+		return it, errors.Wrap(GetError(), "error getting iterator")
 	}
 	return it, nil
 }
@@ -106,6 +106,37 @@ func TestObjectGoInt(t *testing.T) {
 	}
 }
 
+func TestObjectGoFloat64(t *testing.T) {
+	pf, err := NewFloat(1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.DecRef()
+	f, err := pf.Object.GoFloat64()
+	if err != nil {
+		t.Error(err)
+	} else if f != 1.5 {
+		t.Errorf("expected 1.5, got %v", f)
+	}
+
+	// Ints are converted, too.
+	o := mustInt(t, 123).Object
+	defer o.DecRef()
+	f, err = o.GoFloat64()
+	if err != nil {
+		t.Error(err)
+	} else if f != 123 {
+		t.Errorf("expected 123, got %v", f)
+	}
+
+	o = mustString(t, "foo").Object
+	defer o.DecRef()
+	_, err = o.GoFloat64()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
 func TestObjectGoString(t *testing.T) {
 	ps := mustString(t, "foo")
 	defer ps.DecRef()
@@ -5,7 +5,6 @@ package py
 // helpers make life a little easier.
 
 /*
-#cgo pkg-config: python2
 #include "whiskey_py.h"
 */
 import "C"
@@ -43,6 +42,12 @@ var (
 	// False is a wrapper for the Python False value.
 	False Object
 
+	// AssertionError is a wrapper for the Python AssertionError type.
+	AssertionError Object
+
+	// RuntimeError is a wrapper for the Python RuntimeError type.
+	RuntimeError Object
+
 	initialized  = false
 	initializers = []func() error{}
 	finalizers   = []func() error{}
@@ -63,11 +68,12 @@ func initialize() error {
 	if C.whiskey_initialize() != 0 {
 		return errors.New("whiskey_initialize failed")
 	}
-	C.PyEval_InitThreads()
 
 	None.PyObject = C.whiskey_none
 	True.PyObject = C.whiskey_true
 	False.PyObject = C.whiskey_false
+	AssertionError.PyObject = C.PyExc_AssertionError
+	RuntimeError.PyObject = C.PyExc_RuntimeError
 	resetStringCache()
 
 	var errs []error
@@ -97,6 +103,8 @@ func finalize() error {
 	None.PyObject = nil
 	True.PyObject = nil
 	False.PyObject = nil
+	AssertionError.PyObject = nil
+	RuntimeError.PyObject = nil
 	resetStringCache()
 
 	C.whiskey_finalize()
@@ -111,9 +119,18 @@ func finalize() error {
 	return nil
 }
 
+// Initialize initializes the Python interpreter and runs any functions that
+// were registered with AddInitializer. It's safe to call this more than once,
+// but only the first call does anything.
 func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if initialized {
+		return nil
+	}
 	if err := initialize(); err != nil {
 		return err
 	}
+	initialized = true
 	return nil
 }
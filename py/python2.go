@@ -0,0 +1,11 @@
+//go:build !python3
+// +build !python3
+
+package py
+
+// Python 2 is used by default. Build with the python3 tag to use Python 3.
+
+/*
+#cgo pkg-config: python2
+*/
+import "C"
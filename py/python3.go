@@ -0,0 +1,12 @@
+//go:build python3
+// +build python3
+
+package py
+
+// Python 3 is used when building with the python3 tag. This requires the
+// python3-embed pkg-config file, which comes with Python 3.8 and above.
+
+/*
+#cgo pkg-config: python3-embed
+*/
+import "C"
@@ -12,16 +12,32 @@ import (
 	"github.com/pkg/errors"
 )
 
-// String wraps a Python string.
+// String wraps a Python native string. This is a unicode object on Python 3,
+// and a byte string on Python 2.
 type String struct {
 	Object
 }
 
-// String converts a Go string to a Python string.
+// NewString converts a Go string to a Python string. On Python 3, the Go
+// string must be valid UTF-8.
 func NewString(s string) (String, error) {
 	var ps String
 	cs := C.CString(s)
-	ps.PyObject = C.PyString_FromString(cs)
+	ps.PyObject = C.whiskey_string_from_string(cs, C.Py_ssize_t(len(s)))
+	C.free(unsafe.Pointer(cs))
+	if ps.PyObject == nil {
+		return ps, errors.Wrap(GetError(), "error converting to Python string")
+	}
+	return ps, nil
+}
+
+// NewStringLatin1 converts a Go string to a Python string, decoding the bytes
+// as ISO-8859-1 on Python 3. WSGI requires this for strings that came from
+// the HTTP request, as the server can't know how they're really encoded.
+func NewStringLatin1(s string) (String, error) {
+	var ps String
+	cs := C.CString(s)
+	ps.PyObject = C.whiskey_string_from_latin1(cs, C.Py_ssize_t(len(s)))
 	C.free(unsafe.Pointer(cs))
 	if ps.PyObject == nil {
 		return ps, errors.Wrap(GetError(), "error converting to Python string")
@@ -33,11 +49,24 @@ func NewString(s string) (String, error) {
 func (s String) GoString() (string, error) {
 	// NOTE: Don't call C.free(cs) here, because the Python C API says that
 	// the returned char* shouldn't be modified or freed.
-	cs := C.PyString_AsString(s.PyObject)
+	var size C.Py_ssize_t
+	cs := C.whiskey_string_as_string(s.PyObject, &size)
 	if cs == nil {
 		return "", errors.Wrap(GetError(), "error converting to C string")
 	}
-	return C.GoString(cs), nil
+	return C.GoStringN(cs, C.int(size)), nil
+}
+
+// GoStringLatin1 converts the Python string into a Go string, encoding it as
+// ISO-8859-1 on Python 3. This is the inverse of NewStringLatin1.
+func (s String) GoStringLatin1() (string, error) {
+	var b Bytes
+	b.PyObject = C.whiskey_string_as_latin1(s.PyObject)
+	if b.PyObject == nil {
+		return "", errors.Wrap(GetError(), "error encoding string as latin-1")
+	}
+	defer b.DecRef()
+	return string(b.GoBytes()), nil
 }
 
 // Join joins all the items in the list by this string.
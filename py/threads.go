@@ -5,22 +5,101 @@ package py
 */
 import "C"
 
+import "runtime"
+
+// ThreadState wraps a Python thread state. Each goroutine that calls into
+// Python concurrently needs its own thread state, and must acquire it before
+// doing so.
 type ThreadState struct {
 	PyThreadState *C.PyThreadState
+
+	id uint64
 }
 
+// GetThreadState returns the thread state that currently holds the GIL.
 func GetThreadState() *ThreadState {
 	return &ThreadState{PyThreadState: C.PyThreadState_Get()}
 }
 
+// New creates a new thread state for the same interpreter.
 func (ts *ThreadState) New() *ThreadState {
-	return &ThreadState{C.PyThreadState_New(ts.PyThreadState.interp)}
+	return &ThreadState{PyThreadState: C.PyThreadState_New(ts.PyThreadState.interp)}
+}
+
+// Delete clears and frees the thread state. The GIL must be held, by a
+// different thread state, and the thread state can't be used again.
+func (ts *ThreadState) Delete() {
+	C.PyThreadState_Clear(ts.PyThreadState)
+	C.PyThreadState_Delete(ts.PyThreadState)
+	ts.PyThreadState = nil
 }
 
+// DeleteCurrent clears and frees the thread state, which must be the current
+// one, and releases the GIL. It's used in place of Release when the thread
+// state won't be used again, including to unlock the calling goroutine from
+// its OS thread.
+func (ts *ThreadState) DeleteCurrent() {
+	C.PyThreadState_Clear(ts.PyThreadState)
+	C.PyThreadState_DeleteCurrent()
+	ts.PyThreadState = nil
+	runtime.UnlockOSThread()
+}
+
+// Acquire acquires the GIL and makes this the current thread state.
+//
+// Python expects a thread state to stay on the same OS thread while it's
+// current, so this also locks the calling goroutine to its OS thread until
+// Release is called.
 func (ts *ThreadState) Acquire() {
+	runtime.LockOSThread()
 	C.PyEval_RestoreThread(ts.PyThreadState)
 }
 
+// Release releases the GIL, and unlocks the calling goroutine from its OS
+// thread.
 func (ts *ThreadState) Release() {
 	ts.PyThreadState = C.PyEval_SaveThread()
+	runtime.UnlockOSThread()
+}
+
+// SetID gives the thread state an ID that's used to interrupt it, and that
+// identifies it in sys._current_frames(). Python uses the ID of the OS thread
+// that created the thread state, so thread states that were all created on
+// the same thread need to be given unique IDs before they can be interrupted.
+// The ID shouldn't be changed while the thread state is in use. SetID returns
+// false if the ID can't be changed on this version of Python or on this
+// platform, in which case the thread state can't be interrupted.
+func (ts *ThreadState) SetID(id uint64) bool {
+	if C.whiskey_set_thread_id(ts.PyThreadState, C.ulong(id)) == 0 {
+		return false
+	}
+	ts.id = id
+	return true
+}
+
+// ID returns the ID that was given to the thread state with SetID, or 0 if it
+// hasn't been given one.
+func (ts *ThreadState) ID() uint64 {
+	return ts.id
+}
+
+// Interrupt raises exc in the thread state the next time it runs Python
+// code. Code that's blocked in C, or that's waiting for the GIL, won't see it
+// until it returns to Python. The GIL must be held by the caller, which can
+// be another thread state.
+func (ts *ThreadState) Interrupt(exc Object) {
+	if ts.id == 0 {
+		return
+	}
+	C.whiskey_set_async_exc(C.ulong(ts.id), exc.PyObject)
+}
+
+// ClearInterrupt cancels an exception that was raised with Interrupt, if the
+// thread state hasn't run any Python code since. The GIL must be held by the
+// caller.
+func (ts *ThreadState) ClearInterrupt() {
+	if ts.id == 0 {
+		return
+	}
+	C.whiskey_set_async_exc(C.ulong(ts.id), nil)
 }
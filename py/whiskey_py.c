@@ -26,9 +26,33 @@ PyObject * whiskey_true = NULL;
 PyObject * whiskey_false = NULL;
 PyObject * whiskey_module = NULL;
 
+#if PY_MAJOR_VERSION >= 3
+static struct PyModuleDef _module_def = {
+  PyModuleDef_HEAD_INIT,
+  "_whiskey",
+  "Whiskey WSGI internals.",
+  -1,
+  _module_defs
+};
+
+static PyObject * _init_module(void) {
+  return PyModule_Create(&_module_def);
+}
+#endif
+
 int whiskey_initialize() {
+#if PY_MAJOR_VERSION >= 3
+  // Python 3 modules have to be registered before the interpreter is
+  // initialized, rather than being created afterwards.
+  if (PyImport_AppendInittab("_whiskey", _init_module) == -1) {
+    return -1;
+  }
+  Py_Initialize();
+#else
   Py_Initialize();
-	Py_InitModule3("_whiskey", _module_defs, "Whiskey WSGI internals.");
+  PyEval_InitThreads();
+  Py_InitModule3("_whiskey", _module_defs, "Whiskey WSGI internals.");
+#endif
 
   whiskey_none = Py_None;
   whiskey_true = Py_True;
@@ -60,8 +84,16 @@ void whiskey_finalize() {
   Py_Finalize();
 }
 
+int whiskey_check_bytes(PyObject * o) {
+  return PyBytes_Check(o);
+}
+
 int whiskey_check_int(PyObject * o) {
-  return PyInt_Check(o);
+#if PY_MAJOR_VERSION >= 3
+  return PyLong_Check(o);
+#else
+  return PyInt_Check(o) || PyLong_Check(o);
+#endif
 }
 
 int whiskey_check_list(PyObject * o) {
@@ -69,9 +101,106 @@ int whiskey_check_list(PyObject * o) {
 }
 
 int whiskey_check_string(PyObject * o) {
+#if PY_MAJOR_VERSION >= 3
+  return PyUnicode_Check(o);
+#else
   return PyString_Check(o);
+#endif
 }
 
 int whiskey_check_tuple(PyObject * o) {
   return PyTuple_Check(o);
 }
+
+PyObject * whiskey_compile_string(const char * src, const char * filename) {
+  // This is a macro on Python 3, so cgo can't call it directly.
+  return Py_CompileStringFlags(src, filename, Py_file_input, NULL);
+}
+
+PyObject * whiskey_int_from_long(long n) {
+#if PY_MAJOR_VERSION >= 3
+  return PyLong_FromLong(n);
+#else
+  return PyInt_FromLong(n);
+#endif
+}
+
+long whiskey_int_as_long(PyObject * o) {
+#if PY_MAJOR_VERSION >= 3
+  return PyLong_AsLong(o);
+#else
+  return PyInt_AsLong(o);
+#endif
+}
+
+// Strings are unicode on Python 3, and bytes on Python 2. The Go side always
+// deals in UTF-8, except where WSGI requires ISO-8859-1.
+
+PyObject * whiskey_string_from_string(const char * s, Py_ssize_t size) {
+#if PY_MAJOR_VERSION >= 3
+  return PyUnicode_FromStringAndSize(s, size);
+#else
+  return PyString_FromStringAndSize(s, size);
+#endif
+}
+
+PyObject * whiskey_string_from_latin1(const char * s, Py_ssize_t size) {
+#if PY_MAJOR_VERSION >= 3
+  return PyUnicode_DecodeLatin1(s, size, NULL);
+#else
+  return PyString_FromStringAndSize(s, size);
+#endif
+}
+
+PyObject * whiskey_string_as_latin1(PyObject * o) {
+#if PY_MAJOR_VERSION >= 3
+  return PyUnicode_AsLatin1String(o);
+#else
+  Py_INCREF(o);
+  return o;
+#endif
+}
+
+const char * whiskey_string_as_string(PyObject * o, Py_ssize_t * size) {
+#if PY_MAJOR_VERSION >= 3
+  return PyUnicode_AsUTF8AndSize(o, size);
+#else
+  char * s;
+  if (PyString_AsStringAndSize(o, &s, size) == -1) {
+    return NULL;
+  }
+  return s;
+#endif
+}
+
+/* A thread state's ID is normally that of the OS thread that created it, and
+ * PyThreadState_SetAsyncExc() and sys._current_frames() find thread states by
+ * it. thread_id isn't part of Python's public API, so it's only changed on the
+ * versions this has been tested with: 2.7, and 3.8 to 3.13.
+ *
+ * The IDs Whiskey uses are small integers counting up from 1. Python gets the
+ * real ones from pthread_self(), and on Linux and macOS a pthread_t is the
+ * address of the thread's control block. That's never in the first pages of
+ * memory, which aren't mapped, so the two can't collide. */
+#if (defined(__linux__) || defined(__APPLE__)) && \
+    ((PY_VERSION_HEX >= 0x02070000 && PY_VERSION_HEX < 0x03000000) || \
+     (PY_VERSION_HEX >= 0x03080000 && PY_VERSION_HEX < 0x030E0000))
+#define WHISKEY_SET_THREAD_ID 1
+#endif
+
+int whiskey_set_thread_id(PyThreadState * ts, unsigned long id) {
+#ifdef WHISKEY_SET_THREAD_ID
+  ts->thread_id = id;
+  return 1;
+#else
+  return 0;
+#endif
+}
+
+int whiskey_set_async_exc(unsigned long id, PyObject * exc) {
+#if PY_VERSION_HEX >= 0x03070000
+  return PyThreadState_SetAsyncExc(id, exc);
+#else
+  return PyThreadState_SetAsyncExc((long)id, exc);
+#endif
+}
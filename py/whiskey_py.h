@@ -11,9 +11,21 @@ extern PyObject * whiskey_module;
 
 int whiskey_initialize();
 void whiskey_finalize();
+int whiskey_check_bytes(PyObject * o);
 int whiskey_check_int(PyObject * o);
 int whiskey_check_list(PyObject * o);
 int whiskey_check_string(PyObject * o);
 int whiskey_check_tuple(PyObject * o);
 
+PyObject * whiskey_compile_string(const char * src, const char * filename);
+PyObject * whiskey_int_from_long(long n);
+long whiskey_int_as_long(PyObject * o);
+PyObject * whiskey_string_from_string(const char * s, Py_ssize_t size);
+PyObject * whiskey_string_from_latin1(const char * s, Py_ssize_t size);
+PyObject * whiskey_string_as_latin1(PyObject * o);
+const char * whiskey_string_as_string(PyObject * o, Py_ssize_t * size);
+
+int whiskey_set_thread_id(PyThreadState * ts, unsigned long id);
+int whiskey_set_async_exc(unsigned long id, PyObject * exc);
+
 #endif
@@ -0,0 +1,297 @@
+package wsgi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// These are the predefined access log formats. Any other format is parsed
+// as a gunicorn access log format string.
+const (
+	// CommonLogFormat is the NCSA common log format.
+	CommonLogFormat = `%(h)s %(l)s %(u)s %(t)s "%(r)s" %(s)s %(b)s`
+
+	// CombinedLogFormat is the common log format, plus the referer and user
+	// agent. It's gunicorn's default format.
+	CombinedLogFormat = CommonLogFormat + ` "%(f)s" "%(a)s"`
+)
+
+// accessLogFormats maps the names that can be used for the predefined
+// formats to their format strings. JSON is handled separately.
+var accessLogFormats = map[string]string{
+	"common":   CommonLogFormat,
+	"combined": CombinedLogFormat,
+}
+
+// accessEntry is the information about a request that's written to the
+// access log.
+type accessEntry struct {
+	req      *http.Request
+	header   http.Header
+	start    time.Time
+	code     int
+	written  int64
+	duration time.Duration
+	poolWait time.Duration
+}
+
+// accessAtoms are the placeholders that can be used in format strings. These
+// are the same as gunicorn's, except for w, which is Whiskey's own.
+var accessAtoms = map[string]func(e *accessEntry) string{
+	"h": func(e *accessEntry) string { host, _ := splitHostPort(e.req.RemoteAddr); return host },
+	"l": func(e *accessEntry) string { return "-" },
+	"u": func(e *accessEntry) string {
+		if user, _, ok := e.req.BasicAuth(); ok && user != "" {
+			return user
+		}
+		return "-"
+	},
+	"t": func(e *accessEntry) string { return e.start.Format("[02/Jan/2006:15:04:05 -0700]") },
+	"r": func(e *accessEntry) string {
+		return e.req.Method + " " + e.req.RequestURI + " " + e.req.Proto
+	},
+	"m": func(e *accessEntry) string { return e.req.Method },
+	"U": func(e *accessEntry) string { return e.req.URL.Path },
+	"q": func(e *accessEntry) string { return e.req.URL.RawQuery },
+	"H": func(e *accessEntry) string { return e.req.Proto },
+	"s": func(e *accessEntry) string { return strconv.Itoa(e.code) },
+	"B": func(e *accessEntry) string { return strconv.FormatInt(e.written, 10) },
+	"b": func(e *accessEntry) string {
+		if e.written == 0 {
+			return "-"
+		}
+		return strconv.FormatInt(e.written, 10)
+	},
+	"f": func(e *accessEntry) string { return headerOrDash(e.req.Header, "Referer") },
+	"a": func(e *accessEntry) string { return headerOrDash(e.req.Header, "User-Agent") },
+	"T": func(e *accessEntry) string { return strconv.Itoa(int(e.duration / time.Second)) },
+	"M": func(e *accessEntry) string { return strconv.FormatInt(int64(e.duration/time.Millisecond), 10) },
+	"D": func(e *accessEntry) string { return strconv.FormatInt(int64(e.duration/time.Microsecond), 10) },
+	"L": func(e *accessEntry) string { return fmt.Sprintf("%.6f", e.duration.Seconds()) },
+	"w": func(e *accessEntry) string { return fmt.Sprintf("%.6f", e.poolWait.Seconds()) },
+	"p": func(e *accessEntry) string { return "<" + strconv.Itoa(os.Getpid()) + ">" },
+}
+
+func headerOrDash(h http.Header, k string) string {
+	if v := h.Get(k); v != "" {
+		return v
+	}
+	return "-"
+}
+
+// parseAccessLogFormat parses a gunicorn format string, like
+// `%(h)s "%(r)s" %(s)s`, into a list of functions that each write part of the
+// line. Headers can be included with `%({name}i)s` for request headers and
+// `%({name}o)s` for response headers, and environment variables with
+// `%({name}e)s`.
+func parseAccessLogFormat(format string) ([]func(e *accessEntry) string, error) {
+	var parts []func(e *accessEntry) string
+	literal := func(s string) {
+		if s != "" {
+			parts = append(parts, func(e *accessEntry) string { return s })
+		}
+	}
+	for {
+		i := strings.Index(format, "%")
+		if i == -1 {
+			literal(format)
+			return parts, nil
+		}
+		literal(format[:i])
+		format = format[i:]
+		if strings.HasPrefix(format, "%%") {
+			literal("%")
+			format = format[2:]
+			continue
+		}
+		end := strings.Index(format, ")s")
+		if !strings.HasPrefix(format, "%(") || end == -1 {
+			return nil, errors.Errorf("invalid access log format at %q", format)
+		}
+		name := format[2:end]
+		format = format[end+2:]
+		if fn, ok := accessAtoms[name]; ok {
+			parts = append(parts, fn)
+			continue
+		}
+		if len(name) < 3 || name[0] != '{' || name[len(name)-2] != '}' {
+			return nil, errors.Errorf("unknown access log atom %q", name)
+		}
+		key := name[1 : len(name)-2]
+		switch name[len(name)-1] {
+		case 'i':
+			parts = append(parts, func(e *accessEntry) string { return headerOrDash(e.req.Header, key) })
+		case 'o':
+			parts = append(parts, func(e *accessEntry) string { return headerOrDash(e.header, key) })
+		case 'e':
+			parts = append(parts, func(e *accessEntry) string {
+				if v := os.Getenv(key); v != "" {
+					return v
+				}
+				return "-"
+			})
+		default:
+			return nil, errors.Errorf("unknown access log atom %q", name)
+		}
+	}
+}
+
+// accessJSON is the structure of each line in the JSON access log format.
+type accessJSON struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote_addr"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	Duration  float64 `json:"duration"`
+	PoolWait  float64 `json:"pool_wait"`
+}
+
+// AccessLog writes a line to a destination for each request served by a
+// Handler. It's safe to use from multiple goroutines.
+type AccessLog struct {
+	dest  string
+	parts []func(e *accessEntry) string
+	json  bool
+
+	mutex sync.Mutex
+	w     io.WriteCloser
+}
+
+// NewAccessLog opens an access log. The destination can be "-" for stdout,
+// "syslog" for the local syslog daemon, "syslog:" followed by the path to a
+// syslog unix socket, or the path to a file. The format can be "common",
+// "combined", "json", or a gunicorn format string.
+//
+// The predefined formats don't include how long requests took, but JSON does,
+// and format strings can use %(L)s for the duration of the request and %(w)s
+// for the time it spent waiting for a free Request in the pool, in seconds.
+func NewAccessLog(dest, format string) (*AccessLog, error) {
+	l := &AccessLog{dest: dest}
+	if format == "json" {
+		l.json = true
+	} else {
+		if f, ok := accessLogFormats[format]; ok {
+			format = f
+		}
+		parts, err := parseAccessLogFormat(format)
+		if err != nil {
+			return nil, err
+		}
+		l.parts = parts
+	}
+	w, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	l.w = w
+	return l, nil
+}
+
+// open opens the log's destination.
+func (l *AccessLog) open() (io.WriteCloser, error) {
+	switch {
+	case l.dest == "-":
+		return nopCloser{os.Stdout}, nil
+	case l.dest == "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "whiskey")
+		return w, errors.Wrap(err, "error connecting to syslog")
+	case strings.HasPrefix(l.dest, "syslog:"):
+		path := strings.TrimPrefix(l.dest, "syslog:")
+		w, err := syslog.Dial("unixgram", path, syslog.LOG_INFO|syslog.LOG_DAEMON, "whiskey")
+		if err != nil {
+			// Some syslog daemons listen on a stream socket instead.
+			if _, ok := err.(*net.OpError); ok {
+				w, err = syslog.Dial("unix", path, syslog.LOG_INFO|syslog.LOG_DAEMON, "whiskey")
+			}
+		}
+		return w, errors.Wrapf(err, "error connecting to syslog at %s", path)
+	default:
+		f, err := os.OpenFile(l.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		return f, errors.Wrap(err, "error opening access log")
+	}
+}
+
+// ReopenLogs reopens the log file, so that it can be rotated. It does nothing
+// if the log isn't written to a file.
+func (l *AccessLog) ReopenLogs() error {
+	if l.dest == "-" || l.dest == "syslog" || strings.HasPrefix(l.dest, "syslog:") {
+		return nil
+	}
+	w, err := l.open()
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	old := l.w
+	l.w = w
+	l.mutex.Unlock()
+	return old.Close()
+}
+
+// Close closes the log's destination.
+func (l *AccessLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.w.Close()
+}
+
+// log writes a line for a request.
+func (l *AccessLog) log(e *accessEntry) error {
+	var buf bytes.Buffer
+	if l.json {
+		host, _ := splitHostPort(e.req.RemoteAddr)
+		if err := json.NewEncoder(&buf).Encode(accessJSON{
+			Time:      e.start.Format(time.RFC3339Nano),
+			Remote:    host,
+			Method:    e.req.Method,
+			URI:       e.req.RequestURI,
+			Protocol:  e.req.Proto,
+			Status:    e.code,
+			Bytes:     e.written,
+			Referer:   e.req.Header.Get("Referer"),
+			UserAgent: e.req.Header.Get("User-Agent"),
+			Duration:  e.duration.Seconds(),
+			PoolWait:  e.poolWait.Seconds(),
+		}); err != nil {
+			return errors.Wrap(err, "error encoding access log entry")
+		}
+	} else {
+		for _, fn := range l.parts {
+			buf.WriteString(fn(e))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.w.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "error writing access log")
+	}
+	return nil
+}
+
+// nopCloser wraps a writer that shouldn't be closed, like stdout.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,206 @@
+package wsgi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAccessEntry() *accessEntry {
+	req := httptest.NewRequest("GET", "/foo?bar=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("X-Request-Id", "abc")
+	req.SetBasicAuth("alice", "secret")
+	return &accessEntry{
+		req:      req,
+		header:   http.Header{"Content-Type": {"text/plain"}},
+		start:    time.Date(2017, 3, 4, 5, 6, 7, 0, time.FixedZone("", -7*60*60)),
+		code:     200,
+		written:  11,
+		duration: 1500 * time.Millisecond,
+		poolWait: 250 * time.Millisecond,
+	}
+}
+
+// readAccessLog creates an access log in a temporary file, writes the entry
+// to it, and returns what was written.
+func readAccessLog(t *testing.T, format string, e *accessEntry) string {
+	dir, err := ioutil.TempDir("", "whiskey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	l, err := NewAccessLog(path, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.log(e); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	for format, expected := range map[string]string{
+		"common":   `192.0.2.1 - alice [04/Mar/2017:05:06:07 -0700] "GET /foo?bar=1 HTTP/1.1" 200 11`,
+		"combined": `192.0.2.1 - alice [04/Mar/2017:05:06:07 -0700] "GET /foo?bar=1 HTTP/1.1" 200 11 "http://example.com/" "test-agent"`,
+		`%(m)s %(U)s %(q)s %(H)s %(s)s %(B)s %(T)s %(M)s %(D)s %(L)s %(w)s 100%%`: `GET /foo bar=1 HTTP/1.1 200 11 1 1500 1500000 1.500000 0.250000 100%`,
+		`%({x-request-id}i)s %({content-type}o)s %({missing}i)s`:                  `abc text/plain -`,
+	} {
+		if s := readAccessLog(t, format, newTestAccessEntry()); s != expected+"\n" {
+			t.Errorf("%s: expected %q, got %q", format, expected+"\n", s)
+		}
+	}
+
+	e := newTestAccessEntry()
+	e.written = 0
+	if s := readAccessLog(t, "common", e); !strings.HasSuffix(s, " 200 -\n") {
+		t.Errorf("expected - for an empty body, got %q", s)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var v accessJSON
+	if err := json.Unmarshal([]byte(readAccessLog(t, "json", newTestAccessEntry())), &v); err != nil {
+		t.Fatal(err)
+	}
+	expected := accessJSON{
+		Time:      "2017-03-04T05:06:07-07:00",
+		Remote:    "192.0.2.1",
+		Method:    "GET",
+		URI:       "/foo?bar=1",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		Bytes:     11,
+		Referer:   "http://example.com/",
+		UserAgent: "test-agent",
+		Duration:  1.5,
+		PoolWait:  0.25,
+	}
+	if v != expected {
+		t.Errorf("expected %+v, got %+v", expected, v)
+	}
+}
+
+func TestAccessLogFormatErrors(t *testing.T) {
+	for _, format := range []string{"%(h)", "%h", "%(nope)s", "%({x}z)s"} {
+		if _, err := parseAccessLogFormat(format); err == nil {
+			t.Errorf("%q: expected error, got nil", format)
+		}
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whiskey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	l, err := NewAccessLog(path, "%(s)s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// This is what logrotate does: move the file, then signal the server.
+	e := newTestAccessEntry()
+	l.log(e)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReopenLogs(); err != nil {
+		t.Fatal(err)
+	}
+	e.code = 404
+	l.log(e)
+
+	for p, expected := range map[string]string{path + ".1": "200\n", path: "404\n"} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%s: expected %q, got %q", p, expected, b)
+		}
+	}
+}
+
+func TestAccessLogSyslog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whiskey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l, err := NewAccessLog("syslog:"+path, "common")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.log(newTestAccessEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `whiskey[` // the tag and pid
+	if s := string(b[:n]); !strings.Contains(s, expected) ||
+		!strings.Contains(s, `"GET /foo?bar=1 HTTP/1.1" 200 11`) {
+		t.Errorf("unexpected syslog message %q", s)
+	}
+}
+
+func TestHandlerAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whiskey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	h, err := NewHandler("apps:hello", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.AccessLog, err = NewAccessLog(path, `"%(r)s" %(s)s %(b)s`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.AccessLog.Close()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello", nil))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\"GET /hello HTTP/1.1\" 200 11\n"; string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, b)
+	}
+}
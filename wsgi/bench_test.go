@@ -0,0 +1,106 @@
+package wsgi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const slowDelay = time.Millisecond
+
+// slowBody is a request body that trickles in one byte at a time, like an
+// upload from a client on a slow connection.
+type slowBody struct {
+	n int
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(slowDelay)
+	p[0] = 'x'
+	b.n--
+	return 1, nil
+}
+
+func (b *slowBody) Close() error {
+	return nil
+}
+
+// slowWriter is a response writer for a client that's slow to read the
+// response.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(slowDelay)
+	return w.ResponseRecorder.Write(b)
+}
+
+// benchmarkSlowClients measures the throughput of fast requests, while other
+// requests on the same handler are busy with slow clients. If the slow
+// requests held onto the GIL while they were blocked, the fast requests would
+// have to wait for them.
+func benchmarkSlowClients(b *testing.B, slowApp string, slowRequest func() (http.ResponseWriter, *http.Request)) {
+	fast, err := NewHandler("apps:hello", 8)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fast.Close()
+	slow, err := NewHandler(slowApp, 8)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer slow.Close()
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				slow.ServeHTTP(slowRequest())
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			fast.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != 200 {
+				b.Fatalf("expected 200, got %d", w.Code)
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkSlowUploaders(b *testing.B) {
+	benchmarkSlowClients(b, "apps:echo", func() (http.ResponseWriter, *http.Request) {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Body = &slowBody{n: 10}
+		return httptest.NewRecorder(), req
+	})
+}
+
+func BenchmarkSlowReaders(b *testing.B) {
+	benchmarkSlowClients(b, "apps:chunks", func() (http.ResponseWriter, *http.Request) {
+		return slowWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil)
+	})
+}
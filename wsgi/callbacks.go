@@ -17,6 +17,8 @@ func registerCallbacks() {
 	py.RegisterCallback("wsgi_input_read", wsgiInputRead)
 	py.RegisterCallback("wsgi_input_read_line", wsgiInputReadLine)
 	py.RegisterCallback("wsgi_start_response", wsgiStartResponse)
+	py.RegisterCallback("wsgi_write", wsgiWrite)
+	registerMetricsCallbacks()
 }
 
 func wsgiErrorsFlush(args py.Tuple) (py.Object, error) {
@@ -40,7 +42,7 @@ func wsgiErrorsWrite(args py.Tuple) (py.Object, error) {
 }
 
 // wsgiInputRead can be called from the application to read data from the
-// request body, as a string. It can optionally pass an integer to limit the
+// request body, as a byte string. It can optionally pass an integer to limit the
 // amount of data read. It defaults to reading the entire body. It should
 // return an empty string to indicate EOF.
 func wsgiInputRead(args py.Tuple) (py.Object, error) {
@@ -51,7 +53,10 @@ func wsgiInputRead(args py.Tuple) (py.Object, error) {
 	}
 	defer sizeOrNone.DecRef()
 
-	wr := requests[index]
+	wr, err := lookupRequest(index)
+	if err != nil {
+		return py.Object{}, err
+	}
 
 	var b []byte
 	if sizeOrNone != py.None {
@@ -67,7 +72,10 @@ func wsgiInputRead(args py.Tuple) (py.Object, error) {
 
 		// FIXME: it might be nice to recycle these byte buffers
 		b = make([]byte, size)
-		n, err := io.ReadFull(wr.req.Body, b)
+		var n int
+		wr.withoutGIL(func() {
+			n, err = io.ReadFull(wr.reader, b)
+		})
 		switch err {
 		case io.EOF, io.ErrUnexpectedEOF, nil:
 			b = b[:n]
@@ -77,17 +85,19 @@ func wsgiInputRead(args py.Tuple) (py.Object, error) {
 	} else {
 		// Read until the end of the body
 		var err error
-		b, err = ioutil.ReadAll(wr.req.Body)
+		wr.withoutGIL(func() {
+			b, err = ioutil.ReadAll(wr.reader)
+		})
 		if err != nil {
 			return py.Object{}, err
 		}
 	}
 
-	ps, err := py.NewString(string(b))
+	pb, err := py.NewBytes(b)
 	if err != nil {
 		return py.Object{}, err
 	}
-	return ps.Object, err
+	return pb.Object, err
 }
 
 // wsgiInputReadLine reads a single line from the file.
@@ -97,13 +107,19 @@ func wsgiInputReadLine(args py.Tuple) (py.Object, error) {
 		return py.Object{}, err
 	}
 
-	wr := requests[index]
+	wr, err := lookupRequest(index)
+	if err != nil {
+		return py.Object{}, err
+	}
 
-	line, err := wr.reader.ReadString('\n')
+	var line string
+	wr.withoutGIL(func() {
+		line, err = wr.reader.ReadString('\n')
+	})
 	if err != nil && err != io.EOF {
 		return py.Object{}, err
 	}
-	pl, err := py.NewString(line)
+	pl, err := py.NewBytes([]byte(line))
 	if err != nil {
 		return py.Object{}, err
 	}
@@ -111,12 +127,14 @@ func wsgiInputReadLine(args py.Tuple) (py.Object, error) {
 }
 
 // wsgiStartResponse is called by the WSGI application to specify the status
-// code and headers for the response. It can be called more than once,
-// although calls after the first are reserved for setting the excInfo
-// parameter (to convert the response into an error response).
+// code and headers for the response. It can be called more than once, but
+// calls after the first must pass the excInfo parameter (to convert the
+// response into an error response).
+//
+// If the headers haven't been sent yet, the error response replaces the
+// original status and headers. If they have, it's too late to change them, so
+// the exception from excInfo is re-raised in the application instead.
 func wsgiStartResponse(args py.Tuple) (py.Object, error) {
-	// FIXME: this doesn't handle excInfo yet
-
 	var index int
 	var status py.String
 	var headers py.List
@@ -128,6 +146,27 @@ func wsgiStartResponse(args py.Tuple) (py.Object, error) {
 	defer headers.DecRef()
 	defer excInfo.DecRef()
 
+	wr, err := lookupRequest(index)
+	if err != nil {
+		return py.Object{}, err
+	}
+	if excInfo != py.None {
+		if wr.wroteHeaders {
+			t, err := excInfo.Tuple()
+			if err != nil {
+				return py.Object{}, err
+			}
+			e, err := py.NewExceptionInfo(t)
+			if err != nil {
+				return py.Object{}, err
+			}
+			return py.Object{}, e
+		}
+	} else if wr.code != 0 {
+		return py.Object{}, py.NewException(py.AssertionError,
+			"start_response called a second time without exc_info")
+	}
+
 	c, err := convertStatus(status)
 	if err != nil {
 		return py.Object{}, err
@@ -138,10 +177,34 @@ func wsgiStartResponse(args py.Tuple) (py.Object, error) {
 		return py.Object{}, err
 	}
 
-	wr := requests[index]
 	wr.code = c
 	wr.headers = h
 
 	py.None.IncRef()
 	return py.None, nil
 }
+
+// wsgiWrite is the write() callable returned by start_response. It's meant
+// for older applications that use an imperative API to write the response
+// body, rather than returning an iterable. The data is sent to the client
+// immediately, ahead of anything the returned iterable yields later.
+func wsgiWrite(args py.Tuple) (py.Object, error) {
+	var index int
+	var b []byte
+	if err := args.GetItems(&index, &b); err != nil {
+		return py.Object{}, err
+	}
+
+	wr, err := lookupRequest(index)
+	if err != nil {
+		return py.Object{}, err
+	}
+	if len(b) > 0 {
+		if err := wr.write(b); err != nil {
+			return py.Object{}, err
+		}
+	}
+
+	py.None.IncRef()
+	return py.None, nil
+}
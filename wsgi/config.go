@@ -0,0 +1,72 @@
+package wsgi
+
+import (
+	"sync"
+
+	"github.com/noonat/whiskey/py"
+	"github.com/pkg/errors"
+)
+
+var (
+	// configThreadState is used to read config files. configMutex guards it,
+	// as it can only be used by one goroutine at a time.
+	configMutex       sync.Mutex
+	configThreadState *py.ThreadState
+	pyReadConfig      py.Object
+)
+
+// ConfigSetting is a setting read from a Python config file.
+type ConfigSetting struct {
+	Name  string
+	Value string
+}
+
+// ReadConfigFile runs a Python config file, like gunicorn.conf.py, and
+// returns the settings it defines. Each public variable in the file is a
+// setting, with the underscores in its name replaced by dashes, so
+// wsgi_conns = 100 is returned as {"wsgi-conns", "100"}. Booleans are
+// returned as "true" or "false", and lists and tuples are returned as one
+// setting per item.
+//
+// This initializes Python, if it hasn't been already.
+func ReadConfigFile(path string) ([]ConfigSetting, error) {
+	if err := initialize(); err != nil {
+		return nil, err
+	}
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	configThreadState.Acquire()
+	defer configThreadState.Release()
+
+	pp, err := py.NewString(path)
+	if err != nil {
+		return nil, err
+	}
+	defer pp.DecRef()
+	o, err := pyReadConfig.Call(pp.Object)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading config file %s", path)
+	}
+	defer o.DecRef()
+	l, err := o.List()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make([]ConfigSetting, l.Len())
+	for i := range settings {
+		item, err := l.GetItem(i)
+		if err != nil {
+			return nil, err
+		}
+		t, err := item.Tuple()
+		if err == nil {
+			err = t.GetItems(&settings[i].Name, &settings[i].Value)
+		}
+		item.DecRef()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
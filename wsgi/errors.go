@@ -0,0 +1,59 @@
+package wsgi
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+const debugHTML = `<!DOCTYPE html>
+<html>
+<head><title>%d %s</title></head>
+<body>
+<h1>%s</h1>
+<pre>%s</pre>
+</body>
+</html>
+`
+
+// writeError responds to a request that failed with err.
+//
+// If the status and headers haven't been sent yet, this replaces whatever
+// the application was trying to send with an error response with the status
+// code, which is usually 500. In debug mode, the body of that response
+// includes the error, which for Python errors includes the traceback. It's
+// sent as HTML if the client accepts it, or as plain text otherwise.
+//
+// If the status and headers have already been sent, it's too late to tell
+// the client about the error, so this aborts the connection instead. That
+// way the client can at least tell that the response is incomplete, rather
+// than mistaking a truncated body for a complete one.
+func writeError(wr *Request, code int, err error, debug bool) {
+	if wr.wroteHeaders {
+		panic(http.ErrAbortHandler)
+	}
+
+	h := wr.w.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	var body string
+	text := http.StatusText(code)
+	if !debug {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		body = text + "\n"
+	} else if strings.Contains(wr.req.Header.Get("Accept"), "text/html") {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		body = fmt.Sprintf(debugHTML, code, text, text, html.EscapeString(err.Error()))
+	} else {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		body = err.Error() + "\n"
+	}
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	wr.code = code
+	wr.w.WriteHeader(wr.code)
+	n, _ := wr.w.Write([]byte(body))
+	wr.written += int64(n)
+	wr.wroteHeaders = true
+}
@@ -0,0 +1,62 @@
+package wsgi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var errTest = errors.New("test error")
+
+func TestWriteError(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	err := runTestApp(t, "raise_error", httptest.NewRecorder(), req)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	w := httptest.NewRecorder()
+	writeError(newTestRequest(t, w, req), 500, err, false)
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "ValueError") {
+		t.Errorf("expected traceback to be hidden, got %q", body)
+	}
+
+	w = httptest.NewRecorder()
+	writeError(newTestRequest(t, w, req), 500, err, true)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text/plain, got %q", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "ValueError: something went wrong") {
+		t.Errorf("expected traceback, got %q", body)
+	}
+
+	req.Header.Set("Accept", "text/html,*/*")
+	w = httptest.NewRecorder()
+	writeError(newTestRequest(t, w, req), 500, err, true)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected text/html, got %q", ct)
+	}
+}
+
+func TestWriteErrorAfterHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	wr := newTestRequest(t, w, httptest.NewRequest("GET", "/", nil))
+	wr.code = 200
+	wr.ts.Acquire()
+	err := wr.write([]byte("partial"))
+	wr.ts.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("expected ErrAbortHandler panic, got %v", v)
+		}
+	}()
+	writeError(wr, 500, errTest, false)
+}
@@ -0,0 +1,290 @@
+package wsgi
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noonat/whiskey/metrics"
+	"github.com/noonat/whiskey/prefork"
+	"github.com/noonat/whiskey/py"
+	"github.com/pkg/errors"
+)
+
+var (
+	initOnce        sync.Once
+	initErr         error
+	mainThreadState *py.ThreadState
+
+	// gcMetricsOnce registers the garbage collector metrics when the first
+	// handler is created, rather than when Python is initialized, so that a
+	// manager that only reads a config file doesn't add its own garbage
+	// collector's stats to the workers'.
+	gcMetricsOnce sync.Once
+)
+
+// initialize initializes Python and releases the GIL from the thread that
+// initialized it, so that the thread states owned by handlers can acquire it.
+func initialize() error {
+	initOnce.Do(func() {
+		if initErr = py.Initialize(); initErr != nil {
+			return
+		}
+		mainThreadState = py.GetThreadState()
+		mainThreadState.Release()
+		gcThreadState = mainThreadState.New()
+		configThreadState = mainThreadState.New()
+		timeoutThreadState = mainThreadState.New()
+	})
+	return initErr
+}
+
+// Handler is an http.Handler that serves requests using a Python WSGI
+// application. It owns a pool of Request objects, each with its own Python
+// thread state, and each request waits for a free one before calling into
+// Python. The pool grows as needed, and shrinks again when Request objects
+// are idle.
+//
+// Handler doesn't depend on the prefork package's process model, so it can be
+// mounted on any http.ServeMux alongside native Go handlers.
+type Handler struct {
+	// ScriptName is the URL prefix that the application is mounted at. It's
+	// passed to the application as SCRIPT_NAME, and removed from the start of
+	// PATH_INFO.
+	ScriptName string
+
+	// Debug includes the Python traceback in error responses. This shouldn't
+	// be enabled in production, as it can leak sensitive information.
+	Debug bool
+
+	// Logger is used to log errors that occur while serving requests.
+	Logger prefork.Logger
+
+	// AccessLog is written to for each request, if it's set.
+	AccessLog *AccessLog
+
+	// Timeout is how long a request can run before it's interrupted, by
+	// raising whiskey.RequestTimeout in its Python code, and answered with a
+	// 504. PathTimeouts overrides it for requests whose URL path starts with
+	// one of its prefixes, with the longest prefix winning. A timeout of 0
+	// means requests are never interrupted. The time spent waiting for a
+	// Request object from the pool isn't counted.
+	Timeout      time.Duration
+	PathTimeouts map[string]time.Duration
+
+	// MaxQueue is the number of requests that can wait for a Request object
+	// from the pool when they're all in use, and MaxQueueTime is how long
+	// each one can wait. Requests over either limit are answered with a 503
+	// and a Retry-After header. If they're 0, the queue isn't limited.
+	MaxQueue     int
+	MaxQueueTime time.Duration
+
+	// HonorRequestStart counts the time since the X-Request-Start header set
+	// by a load balancer towards MaxQueueTime, so that requests that spent
+	// too long queued in front of the handler are rejected straight away.
+	HonorRequestStart bool
+
+	// MinPoolSize is the number of Request objects that are kept when
+	// they're idle, and PoolIdleTimeout is how long the others are kept
+	// before they're freed. If PoolIdleTimeout is 0, they're never freed.
+	MinPoolSize     int
+	PoolIdleTimeout time.Duration
+
+	application py.Object
+	ts          *py.ThreadState
+	pool        *requestPool
+	stats       handlerStats
+
+	reapOnce  sync.Once
+	reapStop  chan struct{}
+	reapDone  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHandler creates a Handler for a WSGI application. The module should be
+// specified as the module name and the name of the application within it,
+// separated by a colon (e.g. "hello:application"). The name can also be a
+// dotted path to the application, or a call to a factory function that
+// returns it (e.g. "hello:create_app(debug=True)"). The handler will be able
+// to serve up to maxRequests requests simultaneously. Only one Request object
+// is created up front, and the rest are created as they're needed.
+//
+// This initializes Python, if it hasn't been already.
+func NewHandler(module string, maxRequests int) (*Handler, error) {
+	if maxRequests < 1 {
+		return nil, errors.Errorf("a handler must serve at least 1 request at a time, got %d", maxRequests)
+	}
+	if err := initialize(); err != nil {
+		return nil, err
+	}
+	gcMetricsOnce.Do(func() { metrics.Default.OnCollect(collectGC) })
+
+	h := &Handler{
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+		ts:       mainThreadState.New(),
+		reapStop: make(chan struct{}),
+		reapDone: make(chan struct{}),
+	}
+
+	h.ts.Acquire()
+	application, err := loadApplication(module)
+	if err != nil {
+		h.ts.DeleteCurrent()
+		return nil, err
+	}
+	h.ts.Release()
+	h.application = application
+	h.pool = &requestPool{application: application, max: maxRequests}
+
+	wr, _, err := h.pool.get(0)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.pool.put(wr)
+
+	return h, nil
+}
+
+// Close releases the Python resources associated with the handler. It must
+// not be called while requests are still being served. Calling it again does
+// nothing.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() {
+		h.reapOnce.Do(func() { close(h.reapDone) })
+		close(h.reapStop)
+		<-h.reapDone
+		if h.pool != nil {
+			h.freeRequests(h.pool.drain())
+		}
+		h.ts.Acquire()
+		h.application.DecRef()
+		h.application.PyObject = nil
+		h.ts.DeleteCurrent()
+	})
+	return nil
+}
+
+// Stats returns a snapshot of the requests served by the handler.
+func (h *Handler) Stats() Stats {
+	size, max := h.pool.stats()
+	return h.stats.snapshot(size, max)
+}
+
+// reapIdle frees Request objects that have been idle for longer than
+// PoolIdleTimeout, until the handler is closed.
+func (h *Handler) reapIdle() {
+	defer close(h.reapDone)
+	if h.PoolIdleTimeout <= 0 {
+		<-h.reapStop
+		return
+	}
+	ticker := time.NewTicker(h.PoolIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.freeRequests(h.pool.reap(h.PoolIdleTimeout, h.MinPoolSize))
+		case <-h.reapStop:
+			return
+		}
+	}
+}
+
+// freeRequests frees Request objects that have been removed from the pool,
+// along with their thread states.
+func (h *Handler) freeRequests(wrs []*Request) {
+	if len(wrs) == 0 {
+		return
+	}
+	h.ts.Acquire()
+	for _, wr := range wrs {
+		unregisterRequest(wr)
+		wr.Free()
+		wr.ts.Delete()
+	}
+	h.ts.Release()
+	requestPoolSize.Add(-float64(len(wrs)))
+}
+
+// ServeHTTP calls the WSGI application to respond to the request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// The handler's fields can't be changed once it's serving requests, so
+	// the reaper can read them from now on.
+	h.reapOnce.Do(func() { go h.reapIdle() })
+
+	waitStart := time.Now()
+	wr, reason, err := h.getRequest(req, h.arrivedAt(req))
+	if err != nil {
+		h.Logger.Printf("error creating request: %+v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	} else if wr == nil {
+		if reason == rejectClientGone {
+			// There's no one to respond to, so the request isn't logged or
+			// included in the stats.
+			requestsRejected.Inc(reason)
+			return
+		}
+		h.reject(w, req, waitStart, reason)
+		return
+	}
+	poolWait := time.Since(waitStart)
+	h.stats.start(poolWait)
+	requestsInFlight.Add(1)
+	wr.Reset(w, req)
+	wr.scriptName = h.ScriptName
+	wr.acquire()
+	if timeout := h.timeoutFor(req.URL.Path); timeout > 0 {
+		wr.startTimer(timeout, h.Logger)
+	}
+	start := time.Now()
+	defer func() {
+		wr.stopTimer()
+		wr.ts.Release()
+		code, written := wr.code, wr.written
+		duration := time.Since(waitStart)
+		h.stats.finish(code, time.Since(start)-wr.ioTime)
+		requestsInFlight.Add(-1)
+		requestDuration.Observe(duration.Seconds(), strconv.Itoa(code))
+		wr.Reset(nil, nil)
+		h.pool.put(wr)
+
+		h.logAccess(&accessEntry{
+			req:      req,
+			header:   w.Header(),
+			start:    waitStart,
+			code:     code,
+			written:  written,
+			duration: duration,
+			poolWait: poolWait,
+		})
+	}()
+
+	response, err := callApplication(wr)
+	if err == nil {
+		err = writeResponse(wr, response)
+		if closeErr := closeResponse(response); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil && wr.timedOut() {
+		writeError(wr, http.StatusGatewayTimeout, err, h.Debug)
+	} else if err != nil {
+		h.Logger.Printf("error serving request: %+v\n", err)
+		writeError(wr, http.StatusInternalServerError, err, h.Debug)
+	}
+}
+
+// logAccess writes the entry to the access log, if there is one.
+func (h *Handler) logAccess(e *accessEntry) {
+	if h.AccessLog == nil {
+		return
+	}
+	if err := h.AccessLog.log(e); err != nil {
+		h.Logger.Printf("%+v\n", err)
+	}
+}
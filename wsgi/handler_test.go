@@ -0,0 +1,291 @@
+package wsgi
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	h, err := NewHandler("apps:hello", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.ScriptName = "/app"
+
+	mux := http.NewServeMux()
+	mux.Handle("/app/", h)
+	mux.HandleFunc("/go", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello from go"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for path, expected := range map[string]string{
+		"/app/":       "hello world",
+		"/app/foobar": "hello world",
+		"/go":         "hello from go",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: expected 200, got %d", path, resp.StatusCode)
+		}
+		if string(body) != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, body)
+		}
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	h, err := NewHandler("apps:raise_error", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Logger = testLogger{t}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+}
+
+func TestNewHandlerErrors(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewHandler("apps:hello", n); err == nil {
+			t.Errorf("%d: expected error, got nil", n)
+		}
+	}
+	// The handler's thread state is freed when the application can't be
+	// loaded, and Python can still be used afterwards.
+	for i := 0; i < 3; i++ {
+		if _, err := NewHandler("apps:nope", 1); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	}
+	h, err := NewHandler("apps:hello", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	h.Close()
+	h.Close()
+}
+
+func TestHandlerStats(t *testing.T) {
+	ok, err := NewHandler("apps:hello", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ok.Close()
+	fail, err := NewHandler("apps:raise_error", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fail.Close()
+	fail.Logger = testLogger{t}
+
+	for i := 0; i < 3; i++ {
+		ok.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	fail.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	s := ok.Stats()
+	if s.Requests != 3 || s.InFlight != 0 || s.Waiting != 0 || s.PoolSize != 2 {
+		t.Errorf("expected 3 requests, 0 in flight, 0 waiting, and a pool of 2, got %+v", s)
+	}
+	if s.StatusCodes["200"] != 3 {
+		t.Errorf("expected 3 200 responses, got %v", s.StatusCodes)
+	}
+	if s.PythonTime <= 0 {
+		t.Errorf("expected some Python time, got %v", s.PythonTime)
+	}
+	if s := fail.Stats(); s.StatusCodes["500"] != 1 {
+		t.Errorf("expected 1 500 response, got %v", s.StatusCodes)
+	}
+}
+
+// testLogger sends log output to the test's log, so it's only shown when a
+// test fails or when running in verbose mode.
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, args ...interface{}) {
+	l.t.Logf(format, args...)
+}
+
+func (l testLogger) Println(args ...interface{}) {
+	l.t.Log(args...)
+}
+
+func (l testLogger) SetPrefix(prefix string) {
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	h, err := NewHandler("apps:spin", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	var logged bytes.Buffer
+	h.Logger = log.New(&logged, "", 0)
+	h.Timeout = 5 * time.Second
+	h.PathTimeouts = map[string]time.Duration{"/slow": 50 * time.Millisecond}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != 504 {
+		t.Errorf("expected 504, got %d", w.Code)
+	}
+	if s := logged.String(); !strings.Contains(s, "request timed out after 50ms: GET /slow") ||
+		!strings.Contains(s, "in spin") {
+		t.Errorf("expected the timeout to be logged with the stack, got %q", s)
+	}
+
+	// The interrupt doesn't leak into the next request on the same thread
+	// state.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != 200 || w.Body.String() != "done" {
+		t.Errorf("expected 200 done, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerTimeoutConcurrent(t *testing.T) {
+	h, err := NewHandler("apps:spin", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Logger = testLogger{t}
+	h.PathTimeouts = map[string]time.Duration{"/slow": 200 * time.Millisecond}
+
+	// Only the request that timed out is interrupted, and not the one that's
+	// running Python code on the other thread state at the same time. /busy
+	// gets the newer thread state, which Python checks first for a match.
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		slow <- w
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().InFlight != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for /slow, got %+v", h.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/busy", nil))
+	if w.Code != 200 || w.Body.String() != "done" {
+		t.Errorf("expected 200 done, got %d %q", w.Code, w.Body.String())
+	}
+	if w = <-slow; w.Code != 504 {
+		t.Errorf("expected 504, got %d", w.Code)
+	}
+}
+
+func TestHandlerTimeoutFor(t *testing.T) {
+	h := &Handler{
+		Timeout: time.Second,
+		PathTimeouts: map[string]time.Duration{
+			"/api/":        2 * time.Second,
+			"/api/reports": time.Minute,
+			"/health":      0,
+		},
+	}
+	for path, expected := range map[string]time.Duration{
+		"/":                 time.Second,
+		"/api/users":        2 * time.Second,
+		"/api/reports/2020": time.Minute,
+		"/health":           0,
+	} {
+		if timeout := h.timeoutFor(path); timeout != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, timeout)
+		}
+	}
+}
+
+func TestHandlerPoolSize(t *testing.T) {
+	h, err := NewHandler("apps:echo", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Logger = testLogger{t}
+	h.MinPoolSize = 1
+	h.PoolIdleTimeout = 50 * time.Millisecond
+
+	waitFor := func(what string, fn func(s Stats) bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !fn(h.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s, got %+v", what, h.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if s := h.Stats(); s.Threads != 1 || s.PoolSize != 3 {
+		t.Errorf("expected 1 thread state in a pool of 3, got %+v", s)
+	}
+
+	// Each request that's running at once needs its own Request object, so
+	// the pool grows.
+	var writers []*io.PipeWriter
+	done := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/", pr))
+			done <- w.Code
+		}()
+	}
+	waitFor("3 requests", func(s Stats) bool { return s.InFlight == 3 && s.Threads == 3 })
+	requestsMutex.RLock()
+	numRequests := len(requests)
+	requestsMutex.RUnlock()
+	for _, pw := range writers {
+		pw.Close()
+		if code := <-done; code != 200 {
+			t.Errorf("expected 200, got %d", code)
+		}
+	}
+
+	// Once they're idle, it shrinks back to MinPoolSize, and grows again
+	// without using any more indexes.
+	waitFor("the pool to shrink", func(s Stats) bool { return s.Threads == 1 })
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("again")))
+	if w.Code != 200 || w.Body.String() != "again" {
+		t.Errorf("expected 200 again, got %d %q", w.Code, w.Body.String())
+	}
+	requestsMutex.RLock()
+	defer requestsMutex.RUnlock()
+	if len(requests) != numRequests {
+		t.Errorf("expected %d request indexes, got %d", numRequests, len(requests))
+	}
+}
@@ -1,76 +1,254 @@
 package wsgi
 
 import (
+	"context"
+	"crypto/tls"
+	"math/rand"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/noonat/whiskey/prefork"
-	"github.com/noonat/whiskey/py"
 	"github.com/pkg/errors"
 )
 
 // Worker serves requests using a Python WSGI application.
 type Worker struct {
-	Module   string
-	NumConns int
-}
+	Module string
+
+	// NumConns is the number of connections the worker accepts at once,
+	// including idle keep-alive connections. NumThreads is the number of
+	// requests it serves at once, each with its own Python thread state. If
+	// it's 0, it's the same as NumConns. Requests wait for a free thread
+	// state when they're all in use.
+	NumConns   int
+	NumThreads int
+
+	// MinThreads is the number of Python thread states that are kept when
+	// they're idle, and ThreadIdleTimeout is how long the others are kept.
+	// See Handler.MinPoolSize.
+	MinThreads        int
+	ThreadIdleTimeout time.Duration
+
+	// ScriptName is the URL prefix that the application is mounted at. It's
+	// passed to the application as SCRIPT_NAME, and removed from the start of
+	// PATH_INFO.
+	ScriptName string
+
+	// Debug includes the Python traceback in error responses. This shouldn't
+	// be enabled in production, as it can leak sensitive information.
+	Debug bool
+
+	// AccessLog is where the access log is written, and AccessLogFormat is
+	// its format. See NewAccessLog for the supported values. If AccessLog is
+	// empty, requests aren't logged.
+	AccessLog       string
+	AccessLogFormat string
 
-var requests []*Request
+	// CertFile and KeyFile are the TLS certificate and key. If CertFile is
+	// set, the worker serves HTTPS instead of HTTP. The key can be in the
+	// same file as the certificate, in which case KeyFile can be empty.
+	CertFile string
+	KeyFile  string
+
+	// CACerts is a file of CA certificates used to verify client
+	// certificates, and ClientCert is one of the ClientCert constants, which
+	// controls whether clients are asked for one.
+	CACerts    string
+	ClientCert string
+
+	// MaxRequests is the number of requests the worker serves before it asks
+	// the manager to replace it, which limits the damage done by memory
+	// leaks. A random number of requests, up to MaxRequestsJitter, is added
+	// to it, so that the workers aren't all replaced at once. If it's 0, the
+	// worker is never replaced.
+	MaxRequests       int
+	MaxRequestsJitter int
+
+	// RequestTimeout is how long a request can run before its Python code
+	// is interrupted and it's answered with a 504, and PathTimeouts
+	// overrides it for URL path prefixes. See Handler.Timeout.
+	RequestTimeout time.Duration
+	PathTimeouts   map[string]time.Duration
+
+	// MaxQueue, MaxQueueTime, and HonorRequestStart limit how many requests
+	// can wait for a free thread state, and for how long. See
+	// Handler.MaxQueue.
+	MaxQueue          int
+	MaxQueueTime      time.Duration
+	HonorRequestStart bool
+
+	mutex     sync.Mutex
+	accessLog *AccessLog
+	certs     *certLoader
+	h         *Handler
+	srv       *http.Server
+	stopping  bool
+	pipe      *prefork.Pipe
+	requests  int64
+}
 
 // Serve accepts incoming HTTP connections on the listener l, creating a new
 // service goroutines for each. The service goroutines invoke the Python WSGI
 // application to handle the request.
+//
+// The handler isn't closed when Serve returns, as requests may still be
+// running in other goroutines until the process exits.
 func (wrk *Worker) Serve(ln net.Listener, logger prefork.Logger) error {
-	if err := py.Initialize(); err != nil {
-		return err
-	}
-	module := strings.Split(wrk.Module, ":")
-	application, err := loadApplication(module[0], module[1])
+	h, err := NewHandler(wrk.Module, wrk.numThreads())
 	if err != nil {
 		return err
 	}
-	defer application.DecRef()
+	h.ScriptName = wrk.ScriptName
+	h.Debug = wrk.Debug
+	h.Logger = logger
+	h.Timeout = wrk.RequestTimeout
+	h.PathTimeouts = wrk.PathTimeouts
+	h.MaxQueue = wrk.MaxQueue
+	h.MaxQueueTime = wrk.MaxQueueTime
+	h.HonorRequestStart = wrk.HonorRequestStart
+	h.MinPoolSize = wrk.MinThreads
+	h.PoolIdleTimeout = wrk.ThreadIdleTimeout
+	if wrk.AccessLog != "" {
+		al, err := NewAccessLog(wrk.AccessLog, wrk.AccessLogFormat)
+		if err != nil {
+			return err
+		}
+		h.AccessLog = al
+		wrk.mutex.Lock()
+		wrk.accessLog = al
+		wrk.mutex.Unlock()
+	}
 
-	ts := py.GetThreadState()
-	ts.Release()
+	srv := &http.Server{Handler: h}
+	if wrk.MaxRequests > 0 {
+		srv.Handler = wrk.countRequests(h, logger)
+	}
+	wrk.mutex.Lock()
+	stopping := wrk.stopping
+	wrk.h = h
+	wrk.srv = srv
+	wrk.mutex.Unlock()
+	if stopping {
+		return nil
+	}
 
-	pool := make(chan *Request, wrk.NumConns)
-	requests = make([]*Request, wrk.NumConns)
-	for i := 0; i < wrk.NumConns; i++ {
-		wr, err := NewRequest(i, application, ts.New())
+	ln = prefork.WorkerListener(ln, wrk.NumConns, 3*time.Minute)
+	if wrk.CertFile != "" {
+		certs, err := newCertLoader(wrk.CertFile, wrk.KeyFile, wrk.CACerts, wrk.ClientCert)
 		if err != nil {
 			return err
 		}
-		pool <- wr
-		requests[i] = wr
+		wrk.mutex.Lock()
+		wrk.certs = certs
+		wrk.mutex.Unlock()
+		ln = tls.NewListener(ln, certs.TLSConfig())
 	}
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "error serving in worker")
+	}
+
+	return nil
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		wr := <-pool
-		wr.Reset(w, req)
-		wr.ts.Acquire()
-		defer func() {
-			wr.ts.Release()
-			wr.Reset(nil, nil)
-			pool <- wr
-		}()
-
-		response, err := callApplication(wr)
-		if err == nil {
-			err = writeResponse(wr, response)
+// countRequests wraps the handler to count the requests it serves, and asks
+// the manager to replace the worker once it's served enough of them.
+func (wrk *Worker) countRequests(h http.Handler, logger prefork.Logger) http.Handler {
+	max := int64(wrk.MaxRequests)
+	if wrk.MaxRequestsJitter > 0 {
+		max += rand.Int63n(int64(wrk.MaxRequestsJitter) + 1)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req)
+		if atomic.AddInt64(&wrk.requests, 1) != max {
+			return
 		}
-		if err != nil {
-			logger.Printf("error serving request: %+v\n", err)
+		wrk.mutex.Lock()
+		pipe := wrk.pipe
+		wrk.mutex.Unlock()
+		if pipe == nil {
+			// The worker is running in the manager's process, so there's
+			// nothing to replace it.
+			return
+		}
+		logger.Printf("served %d requests, asking to be replaced", max)
+		if err := pipe.Send(prefork.Message{Type: prefork.MessageRetire}); err != nil {
+			logger.Println("error asking to be replaced:", err)
 		}
 	})
+}
 
-	srv := &http.Server{}
-	ln = prefork.WorkerListener(ln, wrk.NumConns, 3*time.Minute)
-	if err := srv.Serve(ln); err != nil {
-		return errors.Wrap(err, "error serving in worker")
+// numThreads returns the number of requests the worker serves at once.
+func (wrk *Worker) numThreads() int {
+	if wrk.NumThreads > 0 {
+		return wrk.NumThreads
 	}
+	return wrk.NumConns
+}
 
-	return nil
+// HeapSize returns the size of the Python heap, so the prefork manager can
+// replace the worker if it's over the configured limit.
+func (wrk *Worker) HeapSize() int64 {
+	return heapSize()
+}
+
+// SetPipe sets the pipe to the manager, which the worker uses to ask to be
+// replaced once it's served MaxRequests requests.
+func (wrk *Worker) SetPipe(p *prefork.Pipe) {
+	wrk.mutex.Lock()
+	wrk.pipe = p
+	wrk.mutex.Unlock()
+}
+
+// Stats returns a snapshot of the requests served by the worker. It's sent
+// to the prefork manager, which aggregates the stats for all of the workers.
+func (wrk *Worker) Stats() interface{} {
+	wrk.mutex.Lock()
+	h := wrk.h
+	wrk.mutex.Unlock()
+	if h == nil {
+		return Stats{PoolSize: int64(wrk.numThreads())}
+	}
+	return h.Stats()
+}
+
+// ReopenLogs reopens the access log file, so that it can be rotated. The
+// prefork package calls this when the worker receives SIGUSR1.
+func (wrk *Worker) ReopenLogs() error {
+	wrk.mutex.Lock()
+	al := wrk.accessLog
+	wrk.mutex.Unlock()
+	if al == nil {
+		return nil
+	}
+	return al.ReopenLogs()
+}
+
+// Reload reloads the TLS certificates from disk, so that they can be renewed
+// without restarting the worker. The prefork package calls this when the
+// worker receives SIGHUP.
+func (wrk *Worker) Reload() error {
+	wrk.mutex.Lock()
+	certs := wrk.certs
+	wrk.mutex.Unlock()
+	if certs == nil {
+		return nil
+	}
+	return certs.Reload()
+}
+
+// Shutdown stops accepting new connections, and waits for the active requests
+// to finish, or for the context to be done. Idle keep-alive connections are
+// closed immediately.
+func (wrk *Worker) Shutdown(ctx context.Context) error {
+	wrk.mutex.Lock()
+	wrk.stopping = true
+	srv := wrk.srv
+	wrk.mutex.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
 }
@@ -0,0 +1,70 @@
+package wsgi
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/noonat/whiskey/prefork"
+)
+
+func TestWorkerMaxRequests(t *testing.T) {
+	mp, wp, err := prefork.NewPipes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	defer wp.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrk := &Worker{Module: "apps:hello", NumConns: 2, MaxRequests: 3}
+	wrk.SetPipe(wp)
+	served := make(chan error, 1)
+	go func() {
+		served <- wrk.Serve(ln, log.New(ioutil.Discard, "", 0))
+	}()
+	defer func() {
+		wrk.Shutdown(context.Background())
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	messages := make(chan prefork.Message, 1)
+	go func() {
+		if msg, err := mp.Recv(); err == nil {
+			messages <- msg
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if i < 3 {
+			select {
+			case msg := <-messages:
+				t.Fatalf("expected no message after %d requests, got %s", i, msg.Type)
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case msg := <-messages:
+			if msg.Type != prefork.MessageRetire {
+				t.Errorf("expected retire message, got %s", msg.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for retire message")
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package wsgi
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noonat/whiskey/metrics"
+	"github.com/noonat/whiskey/py"
+	"github.com/pkg/errors"
+)
+
+var (
+	requestDuration, _ = metrics.Default.NewHistogram("whiskey_request_duration_seconds",
+		"Time taken to serve requests, including waiting for the request pool, by status code.",
+		nil, "code")
+	requestsInFlight, _ = metrics.Default.NewGauge("whiskey_requests_in_flight",
+		"Number of Request objects checked out of the request pool.")
+	requestPoolSize, _ = metrics.Default.NewGauge("whiskey_request_pool_size",
+		"Number of Request objects in the request pool.")
+	requestQueueDepth, _ = metrics.Default.NewGauge("whiskey_request_queue_depth",
+		"Number of requests waiting for a Request object from the pool.")
+	requestsRejected, _ = metrics.Default.NewCounter("whiskey_requests_rejected_total",
+		"Requests that weren't served, by reason. All but client_gone got a 503.",
+		"reason")
+	gilWait, _ = metrics.Default.NewCounter("whiskey_gil_wait_seconds_total",
+		"Time requests spent waiting to acquire the GIL.")
+	gcCounts, _ = metrics.Default.NewGauge("whiskey_python_gc_allocations_since_collection",
+		"Python's garbage collector counts from gc.get_count(), by generation: objects allocated less those freed since the last collection for generation 0, and collections of the next younger generation since the last collection for the others.",
+		"generation")
+	gcCollections, _ = metrics.Default.NewCounter("whiskey_python_gc_collections_total",
+		"Number of collections run by Python's garbage collector, by generation (Python 3 only).",
+		"generation")
+
+	// gcThreadState is used to read the garbage collector's stats and the
+	// heap size, and gcLastCollections is the number of collections for each
+	// generation the last time they were read. They're only used while
+	// holding gcMutex, as the thread state can't be used by two goroutines
+	// at once.
+	gcMutex           sync.Mutex
+	gcThreadState     *py.ThreadState
+	gcLastCollections [3]int
+	pyGCStats         py.Object
+	pyHeapSize        py.Object
+
+	// metricsModuleSource is the source for the whiskey.metrics module. It
+	// lets applications add their own metrics to the same registry as
+	// Whiskey's, with an API similar to the Prometheus client's.
+	metricsModuleSource = `
+from __future__ import absolute_import
+
+import _whiskey
+
+
+class _Child(object):
+
+    def __init__(self, name, label_values):
+        self._name = name
+        self._label_values = label_values
+
+
+class _CounterChild(_Child):
+
+    def inc(self, amount=1):
+        _whiskey.call("metrics_add", (self._name, float(amount),
+                                      self._label_values))
+
+
+class _GaugeChild(_Child):
+
+    def inc(self, amount=1):
+        _whiskey.call("metrics_add", (self._name, float(amount),
+                                      self._label_values))
+
+    def dec(self, amount=1):
+        self.inc(-amount)
+
+    def set(self, value):
+        _whiskey.call("metrics_set", (self._name, float(value),
+                                      self._label_values))
+
+
+class _HistogramChild(_Child):
+
+    def observe(self, value):
+        _whiskey.call("metrics_observe", (self._name, float(value),
+                                          self._label_values))
+
+
+class _Metric(object):
+    _kind = None
+    _child_class = None
+
+    def __init__(self, name, documentation, labelnames=(), buckets=None):
+        self._name = name
+        self._labelnames = tuple(str(n) for n in labelnames)
+        if buckets is not None:
+            buckets = tuple(float(b) for b in buckets)
+        _whiskey.call("metrics_register", (self._kind, name, documentation,
+                                           self._labelnames, buckets))
+
+    def labels(self, *values, **kwargs):
+        if kwargs:
+            if values or set(kwargs) != set(self._labelnames):
+                raise ValueError("expected labels %r" % (self._labelnames,))
+            values = [kwargs[n] for n in self._labelnames]
+        if len(values) != len(self._labelnames):
+            raise ValueError("expected labels %r" % (self._labelnames,))
+        return self._child_class(self._name, tuple(str(v) for v in values))
+
+    def _unlabelled(self):
+        if self._labelnames:
+            raise ValueError("metric %s has labels, use labels()" % self._name)
+        return self._child_class(self._name, ())
+
+
+class Counter(_Metric):
+    _kind = "counter"
+    _child_class = _CounterChild
+
+    def __init__(self, name, documentation, labelnames=()):
+        super(Counter, self).__init__(name, documentation, labelnames)
+
+    def inc(self, amount=1):
+        self._unlabelled().inc(amount)
+
+
+class Gauge(_Metric):
+    _kind = "gauge"
+    _child_class = _GaugeChild
+
+    def __init__(self, name, documentation, labelnames=()):
+        super(Gauge, self).__init__(name, documentation, labelnames)
+
+    def inc(self, amount=1):
+        self._unlabelled().inc(amount)
+
+    def dec(self, amount=1):
+        self._unlabelled().dec(amount)
+
+    def set(self, value):
+        self._unlabelled().set(value)
+
+
+class Histogram(_Metric):
+    _kind = "histogram"
+    _child_class = _HistogramChild
+
+    def observe(self, value):
+        self._unlabelled().observe(value)
+`
+)
+
+// registerMetricsCallbacks creates the callbacks used by the whiskey.metrics
+// module.
+func registerMetricsCallbacks() {
+	py.RegisterCallback("metrics_add", metricsAdd)
+	py.RegisterCallback("metrics_observe", metricsObserve)
+	py.RegisterCallback("metrics_register", metricsRegister)
+	py.RegisterCallback("metrics_set", metricsSet)
+}
+
+// acquire acquires the request's thread state, and records how long it had
+// to wait for the GIL.
+func (wr *Request) acquire() {
+	start := time.Now()
+	wr.ts.Acquire()
+	gilWait.Add(time.Since(start).Seconds())
+}
+
+// collectGC updates the garbage collector metrics. It's called before each
+// snapshot of the metrics registry is taken.
+func collectGC() {
+	gcMutex.Lock()
+	defer gcMutex.Unlock()
+	gcThreadState.Acquire()
+	defer gcThreadState.Release()
+
+	o, err := pyGCStats.Call()
+	if err != nil {
+		return
+	}
+	defer o.DecRef()
+	t, err := o.Tuple()
+	if err != nil {
+		return
+	}
+	var counts, collections [3]int
+	if err := t.GetItems(&counts[0], &counts[1], &counts[2],
+		&collections[0], &collections[1], &collections[2]); err != nil {
+		return
+	}
+	for gen := range counts {
+		label := strconv.Itoa(gen)
+		gcCounts.Set(float64(counts[gen]), label)
+		if collections[gen] >= 0 {
+			gcCollections.Add(float64(collections[gen]-gcLastCollections[gen]), label)
+			gcLastCollections[gen] = collections[gen]
+		}
+	}
+}
+
+// heapSize returns the number of memory blocks allocated by Python, or on
+// Python 2, the number of objects tracked by the garbage collector. It
+// returns 0 if it can't be read.
+func heapSize() int64 {
+	gcMutex.Lock()
+	defer gcMutex.Unlock()
+	gcThreadState.Acquire()
+	defer gcThreadState.Release()
+
+	o, err := pyHeapSize.Call()
+	if err != nil {
+		return 0
+	}
+	defer o.DecRef()
+	n, err := o.GoInt()
+	if err != nil {
+		return 0
+	}
+	return int64(n)
+}
+
+// metricsRegister registers a metric created by the application.
+func metricsRegister(args py.Tuple) (py.Object, error) {
+	var kind, name, help string
+	var labelNamesTuple, bucketsOrNone py.Object
+	if err := args.GetItems(&kind, &name, &help, &labelNamesTuple, &bucketsOrNone); err != nil {
+		return py.Object{}, err
+	}
+	defer labelNamesTuple.DecRef()
+	defer bucketsOrNone.DecRef()
+
+	labelNames, err := goStrings(labelNamesTuple)
+	if err != nil {
+		return py.Object{}, err
+	}
+	switch metrics.Kind(kind) {
+	case metrics.KindCounter:
+		_, err = metrics.Default.NewCounter(name, help, labelNames...)
+	case metrics.KindGauge:
+		_, err = metrics.Default.NewGauge(name, help, labelNames...)
+	case metrics.KindHistogram:
+		var buckets []float64
+		if bucketsOrNone != py.None {
+			if buckets, err = goFloats(bucketsOrNone); err != nil {
+				return py.Object{}, err
+			}
+		}
+		_, err = metrics.Default.NewHistogram(name, help, buckets, labelNames...)
+	default:
+		err = errors.Errorf("unknown metric kind %q", kind)
+	}
+	if err != nil {
+		return py.Object{}, err
+	}
+	py.None.IncRef()
+	return py.None, nil
+}
+
+// metricsAdd adds a value to a counter or gauge.
+func metricsAdd(args py.Tuple) (py.Object, error) {
+	return updateMetric(args, func(metric interface{}, v float64, labelValues []string) error {
+		switch metric := metric.(type) {
+		case *metrics.Counter:
+			return metric.Add(v, labelValues...)
+		case *metrics.Gauge:
+			return metric.Add(v, labelValues...)
+		}
+		return errors.New("metric isn't a counter or gauge")
+	})
+}
+
+// metricsSet sets the value of a gauge.
+func metricsSet(args py.Tuple) (py.Object, error) {
+	return updateMetric(args, func(metric interface{}, v float64, labelValues []string) error {
+		if g, ok := metric.(*metrics.Gauge); ok {
+			return g.Set(v, labelValues...)
+		}
+		return errors.New("metric isn't a gauge")
+	})
+}
+
+// metricsObserve adds a value to a histogram.
+func metricsObserve(args py.Tuple) (py.Object, error) {
+	return updateMetric(args, func(metric interface{}, v float64, labelValues []string) error {
+		if h, ok := metric.(*metrics.Histogram); ok {
+			return h.Observe(v, labelValues...)
+		}
+		return errors.New("metric isn't a histogram")
+	})
+}
+
+// updateMetric parses the arguments for the metrics update callbacks, and
+// calls fn with the metric they refer to.
+func updateMetric(args py.Tuple, fn func(metric interface{}, v float64, labelValues []string) error) (py.Object, error) {
+	var name string
+	var v float64
+	var labelValuesTuple py.Object
+	if err := args.GetItems(&name, &v, &labelValuesTuple); err != nil {
+		return py.Object{}, err
+	}
+	defer labelValuesTuple.DecRef()
+
+	labelValues, err := goStrings(labelValuesTuple)
+	if err != nil {
+		return py.Object{}, err
+	}
+	metric := metrics.Default.Lookup(name)
+	if metric == nil {
+		return py.Object{}, errors.Errorf("unknown metric %q", name)
+	}
+	if err := fn(metric, v, labelValues); err != nil {
+		return py.Object{}, errors.WithMessage(err, name)
+	}
+	py.None.IncRef()
+	return py.None, nil
+}
+
+// goStrings converts a Python tuple of strings into a Go slice.
+func goStrings(o py.Object) ([]string, error) {
+	t, err := o.Tuple()
+	if err != nil {
+		return nil, err
+	}
+	ss := make([]string, t.Len())
+	for i := range ss {
+		item, err := t.GetItem(i)
+		if err != nil {
+			return nil, err
+		}
+		ss[i], err = item.GoString()
+		item.DecRef()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ss, nil
+}
+
+// goFloats converts a Python tuple of floats into a Go slice.
+func goFloats(o py.Object) ([]float64, error) {
+	t, err := o.Tuple()
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]float64, t.Len())
+	for i := range fs {
+		item, err := t.GetItem(i)
+		if err != nil {
+			return nil, err
+		}
+		fs[i], err = item.GoFloat64()
+		item.DecRef()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
@@ -0,0 +1,125 @@
+package wsgi
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/noonat/whiskey/metrics"
+)
+
+// findSeries returns the series for the metric with the given label values
+// from a snapshot, or nil if there isn't one.
+func findSeries(snap metrics.Snapshot, name string, labelValues ...string) *metrics.Series {
+	for _, f := range snap {
+		if f.Name != name {
+			continue
+		}
+		for i, s := range f.Series {
+			if len(s.LabelValues) == 0 && len(labelValues) == 0 ||
+				reflect.DeepEqual(s.LabelValues, labelValues) {
+				return &f.Series[i]
+			}
+		}
+	}
+	return nil
+}
+
+func TestPythonMetrics(t *testing.T) {
+	h, err := NewHandler("metrics_app:application", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	before := metrics.Default.Snapshot()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, expected := range []string{
+		"ValueError: metric test_signups_total has labels, use labels()",
+		"RuntimeError: metric test_signups_total is already registered",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected response to contain %q, got %q", expected, w.Body.String())
+		}
+	}
+
+	// The counters are compared to the snapshot from before the request, in
+	// case the test is run more than once.
+	snap := metrics.Default.Snapshot()
+	for _, test := range []struct {
+		name        string
+		labelValues []string
+		expected    float64
+	}{
+		{"test_signups_total", []string{"free"}, 1},
+		{"test_signups_total", []string{"pro"}, 2},
+	} {
+		var prev float64
+		if s := findSeries(before, test.name, test.labelValues...); s != nil {
+			prev = s.Value
+		}
+		if s := findSeries(snap, test.name, test.labelValues...); s == nil || s.Value-prev != test.expected {
+			t.Errorf("%s%v: expected an increase of %v, got %+v", test.name, test.labelValues, test.expected, s)
+		}
+	}
+	if s := findSeries(snap, "test_queue_size"); s == nil || s.Value != 4 {
+		t.Errorf("test_queue_size: expected 4, got %+v", s)
+	}
+	if s := findSeries(snap, "test_sizes"); s == nil || s.BucketCounts[1] != s.Count {
+		t.Errorf("test_sizes: expected all counts in the second bucket, got %+v", s)
+	}
+
+	// Whiskey's own metrics are in the same registry.
+	var count uint64
+	if s := findSeries(before, "whiskey_request_duration_seconds", "200"); s != nil {
+		count = s.Count
+	}
+	if s := findSeries(snap, "whiskey_request_duration_seconds", "200"); s == nil || s.Count != count+1 {
+		t.Errorf("expected request to be counted in whiskey_request_duration_seconds, got %+v", s)
+	}
+	if s := findSeries(snap, "whiskey_requests_in_flight"); s == nil || s.Value != 0 {
+		t.Errorf("expected no requests in flight, got %+v", s)
+	}
+}
+
+func TestPythonGCMetrics(t *testing.T) {
+	h, err := NewHandler("metrics_app:hold_objects", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	get := func(path string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// The app allocates 2000 objects with the garbage collector disabled,
+	// so they're all counted in generation 0. A few objects allocated
+	// before it was disabled may have been freed since.
+	get("/hold")
+	defer get("/release")
+	snap := metrics.Default.Snapshot()
+	if s := findSeries(snap, "whiskey_python_gc_allocations_since_collection", "0"); s == nil || s.Value < 1900 {
+		t.Errorf("expected at least 1900 allocations in generation 0, got %+v", s)
+	}
+	for _, gen := range []string{"1", "2"} {
+		if s := findSeries(snap, "whiskey_python_gc_allocations_since_collection", gen); s == nil {
+			t.Errorf("expected a count for generation %s", gen)
+		}
+	}
+}
+
+func TestHeapSize(t *testing.T) {
+	if n := heapSize(); n <= 0 {
+		t.Errorf("expected a positive heap size, got %d", n)
+	}
+}
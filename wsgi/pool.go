@@ -3,10 +3,183 @@ package wsgi
 import (
 	"bufio"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/noonat/whiskey/py"
+	"github.com/pkg/errors"
 )
 
+var (
+	requests      []*Request
+	freeIndexes   []int
+	requestsMutex = &sync.RWMutex{}
+)
+
+// newRequest creates a new Request object and adds it to the list of requests
+// that Python callbacks can look up by index. Indexes of Request objects that
+// have been unregistered are reused.
+func newRequest(application py.Object, ts *py.ThreadState) (*Request, error) {
+	requestsMutex.Lock()
+	var index int
+	if n := len(freeIndexes); n > 0 {
+		index = freeIndexes[n-1]
+		freeIndexes = freeIndexes[:n-1]
+	} else {
+		index = len(requests)
+		requests = append(requests, nil)
+	}
+	requestsMutex.Unlock()
+
+	wr, err := NewRequest(index, application, ts)
+	if err != nil {
+		requestsMutex.Lock()
+		freeIndexes = append(freeIndexes, index)
+		requestsMutex.Unlock()
+		return nil, err
+	}
+
+	requestsMutex.Lock()
+	requests[index] = wr
+	requestsMutex.Unlock()
+	return wr, nil
+}
+
+// lookupRequest returns the Request object with the given index.
+func lookupRequest(index int) (*Request, error) {
+	requestsMutex.RLock()
+	defer requestsMutex.RUnlock()
+	if index < 0 || index >= len(requests) || requests[index] == nil {
+		return nil, errors.Errorf("invalid request index %d", index)
+	}
+	return requests[index], nil
+}
+
+// unregisterRequest removes the Request object from the list of requests, so
+// that it can no longer be looked up by Python callbacks, and its index can
+// be reused.
+func unregisterRequest(wr *Request) {
+	requestsMutex.Lock()
+	requests[wr.index] = nil
+	freeIndexes = append(freeIndexes, wr.index)
+	requestsMutex.Unlock()
+}
+
+// requestPool holds a Handler's Request objects. It creates them as they're
+// needed, up to max, so that idle connections don't hold on to Python
+// resources. Idle Request objects are kept on a stack, so the most recently
+// used ones are reused first, and the rest can be freed once they've been
+// idle for a while.
+type requestPool struct {
+	application py.Object
+	max         int
+
+	mutex   sync.Mutex
+	size    int
+	idle    []*Request
+	waiters []chan *Request
+}
+
+// get takes an idle Request object from the pool. If there aren't any, and
+// the pool has room for another, it creates one. Otherwise, if fewer than
+// maxQueue requests are already waiting, or maxQueue is 0, it returns a
+// channel that will be sent the next Request object that's put back. If it
+// returns neither, the queue is full.
+func (p *requestPool) get(maxQueue int) (*Request, chan *Request, error) {
+	p.mutex.Lock()
+	if n := len(p.idle); n > 0 {
+		wr := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return wr, nil, nil
+	}
+	if p.size < p.max {
+		p.size++
+		p.mutex.Unlock()
+		wr, err := newRequest(p.application, mainThreadState.New())
+		if err != nil {
+			p.mutex.Lock()
+			p.size--
+			p.mutex.Unlock()
+			return nil, nil, err
+		}
+		requestPoolSize.Add(1)
+		return wr, nil, nil
+	}
+	defer p.mutex.Unlock()
+	if maxQueue > 0 && len(p.waiters) >= maxQueue {
+		return nil, nil, nil
+	}
+	wait := make(chan *Request, 1)
+	p.waiters = append(p.waiters, wait)
+	return nil, wait, nil
+}
+
+// cancel stops waiting on a channel returned by get. If a Request object was
+// already sent on it, it returns false, and the caller must receive it.
+func (p *requestPool) cancel(wait chan *Request) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, w := range p.waiters {
+		if w == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// put returns a Request object to the pool, handing it to the request that's
+// been waiting the longest, if there is one.
+func (p *requestPool) put(wr *Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.waiters) > 0 {
+		wait := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		wait <- wr
+		return
+	}
+	wr.idleSince = time.Now()
+	p.idle = append(p.idle, wr)
+}
+
+// reap removes the Request objects that have been idle for longer than
+// timeout, leaving at least min in the pool, and returns them so they can be
+// freed.
+func (p *requestPool) reap(timeout time.Duration, min int) []*Request {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	cutoff := time.Now().Add(-timeout)
+	n := 0
+	for n < len(p.idle) && p.size-n > min && p.idle[n].idleSince.Before(cutoff) {
+		n++
+	}
+	reaped := append([]*Request(nil), p.idle[:n]...)
+	p.idle = p.idle[n:]
+	p.size -= n
+	return reaped
+}
+
+// drain removes all of the idle Request objects from the pool, and returns
+// them so they can be freed.
+func (p *requestPool) drain() []*Request {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	drained := p.idle
+	p.idle = nil
+	p.size -= len(drained)
+	return drained
+}
+
+// stats returns the number of Request objects the pool has created, and the
+// most it can create.
+func (p *requestPool) stats() (size, max int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size, p.max
+}
+
 // Request tracks the state associated with a single WSGI request. This is
 // necessary because we need to track this data across Python boundaries,
 // where we can't pass the Go pointer data into Python.
@@ -23,8 +196,24 @@ type Request struct {
 	req    *http.Request
 	reader *bufio.Reader
 
-	code    int
-	headers http.Header
+	code         int
+	headers      http.Header
+	wroteHeaders bool
+
+	scriptName string
+
+	// ioTime is the time the request has spent without the GIL, while it
+	// was blocked on I/O.
+	ioTime time.Duration
+
+	// written is the number of bytes of the response body that have been
+	// sent to the client.
+	written int64
+
+	// idleSince is when the Request object was put back in the pool.
+	idleSince time.Time
+
+	timer requestTimer
 }
 
 // NewRequest creates a new Request object for the given index. This also
@@ -39,6 +228,10 @@ func NewRequest(index int, application py.Object, ts *py.ThreadState) (*Request,
 	}
 
 	ts.Acquire()
+	// The thread states are all created on the same OS thread, so they need
+	// their own IDs for requests to be interrupted when they time out. If the
+	// ID can't be set, timeouts are only logged.
+	ts.SetID(uint64(index) + 1)
 	var err error
 	wr.startResponse, wr.wsgiInput, wr.wsgiErrors, err = createRequestObjects(wr.index)
 	ts.Release()
@@ -70,10 +263,62 @@ func (wr *Request) Reset(w http.ResponseWriter, req *http.Request) {
 	wr.w = w
 	wr.req = req
 	wr.code = 0
+	wr.ioTime = 0
+	wr.written = 0
 	wr.headers = nil
+	wr.wroteHeaders = false
 	if req != nil {
 		wr.reader.Reset(wr.req.Body)
 	} else {
 		wr.reader.Reset(nil)
 	}
 }
+
+// writeHeaders sends the status code and headers that the application passed
+// to start_response. It does nothing if they have already been sent.
+func (wr *Request) writeHeaders() error {
+	if wr.wroteHeaders {
+		return nil
+	} else if wr.code == 0 {
+		return errors.New("application did not call start_response")
+	}
+	for k, vs := range wr.headers {
+		for _, v := range vs {
+			wr.w.Header().Add(k, v)
+		}
+	}
+	wr.w.WriteHeader(wr.code)
+	wr.wroteHeaders = true
+	return nil
+}
+
+// write sends a chunk of the response body to the client, sending the status
+// code and headers first if necessary.
+func (wr *Request) write(b []byte) error {
+	if err := wr.writeHeaders(); err != nil {
+		return err
+	}
+	var n int
+	var err error
+	wr.withoutGIL(func() {
+		n, err = wr.w.Write(b)
+	})
+	wr.written += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "error writing response")
+	}
+	return nil
+}
+
+// withoutGIL releases the request's thread state while fn runs, so that other
+// requests can run Python code while this one is blocked on the network. fn
+// must not touch any Python objects.
+func (wr *Request) withoutGIL(fn func()) {
+	start := time.Now()
+	wr.ts.Release()
+	defer func() {
+		wr.acquire()
+		wr.ioTime += time.Since(start)
+	}()
+	fn()
+}
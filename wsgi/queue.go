@@ -0,0 +1,141 @@
+package wsgi
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are the reasons a request can be rejected, which label the
+// whiskey_requests_rejected_total metric.
+const (
+	rejectClientGone   = "client_gone"
+	rejectQueueFull    = "queue_full"
+	rejectQueueTimeout = "queue_timeout"
+	rejectStale        = "stale"
+)
+
+// getRequest gets a Request object from the pool for req, which arrived at
+// the given time. If it returns nil without an error, the request should be
+// rejected for the reason it returns.
+func (h *Handler) getRequest(req *http.Request, arrived time.Time) (*Request, string, error) {
+	var deadline time.Time
+	if h.MaxQueueTime > 0 {
+		deadline = arrived.Add(h.MaxQueueTime)
+		if !time.Now().Before(deadline) {
+			return nil, rejectStale, nil
+		}
+	}
+
+	wr, wait, err := h.pool.get(h.MaxQueue)
+	if err != nil {
+		return nil, "", err
+	} else if wr != nil {
+		return wr, "", nil
+	} else if wait == nil {
+		return nil, rejectQueueFull, nil
+	}
+
+	h.stats.wait()
+	requestQueueDepth.Add(1)
+	defer func() {
+		h.stats.stopWaiting()
+		requestQueueDepth.Add(-1)
+	}()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case wr := <-wait:
+		return wr, "", nil
+	case <-timeout:
+		if h.pool.cancel(wait) {
+			return nil, rejectQueueTimeout, nil
+		}
+		// A Request object was handed over just as the deadline passed.
+		return <-wait, "", nil
+	case <-req.Context().Done():
+		if !h.pool.cancel(wait) {
+			// A Request object was handed over just as the client went
+			// away, so pass it on to the next request instead.
+			h.pool.put(<-wait)
+		}
+		return nil, rejectClientGone, nil
+	}
+}
+
+// arrivedAt returns the time that req arrived. If HonorRequestStart is set
+// and the load balancer gave it an X-Request-Start header, that's when the
+// load balancer received it. Otherwise it's now.
+func (h *Handler) arrivedAt(req *http.Request) time.Time {
+	now := time.Now()
+	if !h.HonorRequestStart {
+		return now
+	}
+	t, ok := parseRequestStart(req.Header.Get("X-Request-Start"))
+	if !ok || t.After(now) {
+		return now
+	}
+	return t
+}
+
+// parseRequestStart parses an X-Request-Start header. The value is a Unix
+// timestamp with an optional "t=" prefix, in seconds (e.g. nginx's $msec),
+// milliseconds, or microseconds. The unit is guessed from the size of the
+// number.
+func parseRequestStart(s string) (time.Time, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "t=")
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return time.Time{}, false
+	}
+	switch {
+	case n > 1e15:
+		n /= 1e6
+	case n > 1e12:
+		n /= 1e3
+	}
+	sec, frac := math.Modf(n)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// reject responds to a request with a 503, because it couldn't get a Request
+// object from the pool in time. start is when the handler was called.
+func (h *Handler) reject(w http.ResponseWriter, req *http.Request, start time.Time, reason string) {
+	h.stats.reject()
+	requestsRejected.Inc(reason)
+	code := http.StatusServiceUnavailable
+	duration := time.Since(start)
+	requestDuration.Observe(duration.Seconds(), strconv.Itoa(code))
+
+	// Suggest retrying after about as long as a request could have waited,
+	// so that clients don't retry while the queue is still full.
+	retryAfter := int64(math.Ceil(h.MaxQueueTime.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	body := http.StatusText(code) + "\n"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	// Don't let rejected clients hold on to a connection.
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(code)
+	n, _ := w.Write([]byte(body))
+
+	h.logAccess(&accessEntry{
+		req:      req,
+		header:   w.Header(),
+		start:    start,
+		code:     code,
+		written:  int64(n),
+		duration: duration,
+		poolWait: duration,
+	})
+}
@@ -0,0 +1,170 @@
+package wsgi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerQueue(t *testing.T) {
+	h, err := NewHandler("apps:echo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Logger = testLogger{t}
+	h.MaxQueue = 1
+	h.MaxQueueTime = 200 * time.Millisecond
+	h.HonorRequestStart = true
+
+	waitFor := func(what string, fn func(s Stats) bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !fn(h.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s, got %+v", what, h.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	serve := func(body io.Reader, header ...string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", body)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		go func() {
+			h.ServeHTTP(w, req)
+			done <- w
+		}()
+		return done
+	}
+
+	// The first request holds the only Request object until its body is
+	// closed.
+	pr, pw := io.Pipe()
+	first := serve(pr)
+	waitFor("the first request", func(s Stats) bool { return s.InFlight == 1 })
+
+	// The second request waits in the queue, which is then full, so the
+	// third is rejected straight away.
+	second := serve(strings.NewReader("second"))
+	waitFor("the second request to queue", func(s Stats) bool { return s.Waiting == 1 })
+	w := <-serve(strings.NewReader("third"))
+	if w.Code != 503 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected 503 with Retry-After 1 for a full queue, got %d %v", w.Code, w.Header())
+	}
+
+	// The second request gives up once it's waited too long.
+	select {
+	case w := <-second:
+		if w.Code != 503 {
+			t.Errorf("expected 503 after waiting too long, got %d", w.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the second request to be rejected")
+	}
+
+	pw.Close()
+	if w := <-first; w.Code != 200 {
+		t.Errorf("expected 200 for the first request, got %d", w.Code)
+	}
+
+	// Requests that waited too long at the load balancer are rejected, even
+	// though there's a free Request object.
+	stale := fmt.Sprintf("t=%d", time.Now().Add(-time.Second).UnixNano()/1e3)
+	if w := <-serve(strings.NewReader("stale"), "X-Request-Start", stale); w.Code != 503 {
+		t.Errorf("expected 503 for a stale request, got %d", w.Code)
+	}
+	fresh := fmt.Sprintf("t=%.3f", float64(time.Now().UnixNano())/1e9)
+	if w := <-serve(strings.NewReader("fresh"), "X-Request-Start", fresh); w.Code != 200 || w.Body.String() != "fresh" {
+		t.Errorf("expected 200 fresh for a fresh request, got %d %q", w.Code, w.Body.String())
+	}
+
+	s := h.Stats()
+	if s.Requests != 5 || s.Rejected != 3 || s.StatusCodes["503"] != 3 || s.Waiting != 0 {
+		t.Errorf("expected 5 requests with 3 rejected, got %+v", s)
+	}
+}
+
+func TestHandlerQueueClientGone(t *testing.T) {
+	h, err := NewHandler("apps:echo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Logger = testLogger{t}
+
+	waitFor := func(what string, fn func(s Stats) bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !fn(h.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s, got %+v", what, h.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The first request holds the only Request object until its body is
+	// closed, so the second has to wait.
+	pr, pw := io.Pipe()
+	first := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", pr))
+		close(first)
+	}()
+	waitFor("the first request", func(s Stats) bool { return s.InFlight == 1 })
+	ctx, cancel := context.WithCancel(context.Background())
+	second := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("second"))
+		h.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		close(second)
+	}()
+	waitFor("the second request to queue", func(s Stats) bool { return s.Waiting == 1 })
+
+	// The second request stops waiting once its client goes away, without
+	// a deadline to wait for.
+	cancel()
+	select {
+	case <-second:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the second request to give up")
+	}
+	// It isn't counted as rejected, as it didn't get a 503.
+	if s := h.Stats(); s.Waiting != 0 || s.Rejected != 0 || s.Requests != 0 {
+		t.Errorf("expected the second request to stop waiting, got %+v", s)
+	}
+
+	// The Request object goes back to the pool for the next request.
+	pw.Close()
+	<-first
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("third")))
+	if w.Code != 200 || w.Body.String() != "third" {
+		t.Errorf("expected 200 third for the third request, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestParseRequestStart(t *testing.T) {
+	expected := time.Unix(1600000000, 123000000)
+	for _, s := range []string{
+		"t=1600000000.123",
+		"1600000000.123",
+		"t=1600000000123",
+		"t=1600000000123000",
+	} {
+		if ts, ok := parseRequestStart(s); !ok || ts.Sub(expected).Round(time.Millisecond) != 0 {
+			t.Errorf("%q: expected %v, got %v, %v", s, expected, ts, ok)
+		}
+	}
+	for _, s := range []string{"", "t=", "t=soon", "t=-1"} {
+		if _, ok := parseRequestStart(s); ok {
+			t.Errorf("%q: expected failure", s)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package wsgi
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of the requests served by a Handler. The durations are
+// totals across all of the requests, in seconds.
+type Stats struct {
+	// Requests is the number of requests that have been served.
+	Requests int64 `json:"requests"`
+
+	// InFlight is the number of requests being served right now, and PoolSize
+	// is the number that can be served at once. When they're equal, the
+	// handler is saturated, and Waiting requests are queued for a slot.
+	InFlight int64 `json:"in_flight"`
+	Waiting  int64 `json:"waiting"`
+	PoolSize int64 `json:"pool_size"`
+
+	// Threads is the number of slots in the pool that have been created, each
+	// with its own Python thread state. Slots are created as they're needed,
+	// up to PoolSize, and freed when they've been idle for a while.
+	Threads int64 `json:"threads"`
+
+	// Rejected is the number of requests that were answered with a 503,
+	// because the queue was full or they waited too long for a slot. They're
+	// included in Requests.
+	Rejected int64 `json:"rejected"`
+
+	// PoolWait is the time requests spent waiting for a slot in the pool.
+	PoolWait float64 `json:"pool_wait_seconds"`
+
+	// PythonTime is the time requests spent holding the GIL.
+	PythonTime float64 `json:"python_seconds"`
+
+	// StatusCodes counts the responses by status code.
+	StatusCodes map[string]int64 `json:"status_codes"`
+}
+
+// handlerStats accumulates the stats for a Handler.
+type handlerStats struct {
+	mutex       sync.Mutex
+	requests    int64
+	inFlight    int64
+	waiting     int64
+	rejected    int64
+	poolWait    time.Duration
+	pythonTime  time.Duration
+	statusCodes map[int]int64
+}
+
+// wait is called when a request starts waiting for a slot in the pool.
+func (s *handlerStats) wait() {
+	s.mutex.Lock()
+	s.waiting++
+	s.mutex.Unlock()
+}
+
+// stopWaiting is called when a request that was waiting gets a slot in the
+// pool, or gives up on getting one.
+func (s *handlerStats) stopWaiting() {
+	s.mutex.Lock()
+	s.waiting--
+	s.mutex.Unlock()
+}
+
+// start is called when a request gets a slot in the pool, after waiting for
+// the given duration.
+func (s *handlerStats) start(wait time.Duration) {
+	s.mutex.Lock()
+	s.inFlight++
+	s.poolWait += wait
+	s.mutex.Unlock()
+}
+
+// finish is called when a request has been served.
+func (s *handlerStats) finish(code int, pythonTime time.Duration) {
+	s.mutex.Lock()
+	s.inFlight--
+	s.requests++
+	s.pythonTime += pythonTime
+	if s.statusCodes == nil {
+		s.statusCodes = map[int]int64{}
+	}
+	s.statusCodes[code]++
+	s.mutex.Unlock()
+}
+
+// reject is called when a request is answered with a 503 instead of getting
+// a slot in the pool.
+func (s *handlerStats) reject() {
+	s.mutex.Lock()
+	s.requests++
+	s.rejected++
+	if s.statusCodes == nil {
+		s.statusCodes = map[int]int64{}
+	}
+	s.statusCodes[http.StatusServiceUnavailable]++
+	s.mutex.Unlock()
+}
+
+func (s *handlerStats) snapshot(threads, poolSize int) Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := Stats{
+		Requests:    s.requests,
+		InFlight:    s.inFlight,
+		Waiting:     s.waiting,
+		Rejected:    s.rejected,
+		PoolSize:    int64(poolSize),
+		Threads:     int64(threads),
+		PoolWait:    s.poolWait.Seconds(),
+		PythonTime:  s.pythonTime.Seconds(),
+		StatusCodes: map[string]int64{},
+	}
+	for code, n := range s.statusCodes {
+		stats.StatusCodes[strconv.Itoa(code)] = n
+	}
+	return stats
+}
@@ -0,0 +1,126 @@
+import sys
+import time
+
+
+def hello(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    return [b'hello', b' ', b'world']
+
+
+def legacy_write(environ, start_response):
+    write = start_response('200 OK', [('Content-Type', 'text/plain')])
+    write(b'hello')
+    write(b' ')
+    return [b'world']
+
+
+def start_response_twice(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    try:
+        start_response('500 Internal Server Error', [])
+    except AssertionError:
+        return [b'raised']
+    return [b'did not raise']
+
+
+def error_before_headers(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    try:
+        raise ValueError('oops')
+    except ValueError:
+        start_response('500 Internal Server Error',
+                       [('Content-Type', 'text/html')], sys.exc_info())
+    return [b'error']
+
+
+def error_after_headers(environ, start_response):
+    write = start_response('200 OK', [('Content-Type', 'text/plain')])
+    write(b'partial')
+    try:
+        raise ValueError('oops')
+    except ValueError:
+        try:
+            start_response('500 Internal Server Error', [], sys.exc_info())
+        except ValueError:
+            return [b' raised']
+    return [b' did not raise']
+
+
+closed = []
+
+
+def generator(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    try:
+        yield b'hello'
+        yield b' world'
+    finally:
+        closed.append(environ['PATH_INFO'])
+
+
+class ClosingIterable(object):
+
+    def __init__(self, environ, chunks):
+        self.environ = environ
+        self.chunks = chunks
+
+    def __iter__(self):
+        return iter(self.chunks)
+
+    def close(self):
+        closed.append(self.environ['PATH_INFO'])
+
+
+def bad_chunk(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    return ClosingIterable(environ, [b'hello', 1])
+
+
+def raise_error(environ, start_response):
+    raise ValueError('something went wrong')
+
+
+def echo(environ, start_response):
+    body = environ['wsgi.input'].read()
+    start_response('200 OK', [('Content-Type', 'application/octet-stream')])
+    return [body]
+
+
+def chunks(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    return [b'chunk'] * 10
+
+
+def create_app(greeting='hello', name='world'):
+    def app(environ, start_response):
+        start_response('200 OK', [('Content-Type', 'text/plain')])
+        return [greeting.encode('ascii'), b' ', name.encode('ascii')]
+    return app
+
+
+class Container(object):
+
+    def __init__(self):
+        self.wsgi_app = hello
+
+
+container = Container()
+not_callable = 'hello'
+
+
+def tls_info(environ, start_response):
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    info = [environ['wsgi.url_scheme'], environ.get('SSL_CLIENT_VERIFY', ''),
+            environ.get('SSL_CLIENT_S_DN', '')]
+    return [' '.join(info).encode('latin-1')]
+
+
+def spin(environ, start_response):
+    # /busy runs Python code for a second, and anything but /fast runs it for
+    # long enough that it's expected to time out.
+    seconds = {'/fast': 0, '/busy': 1}.get(environ['PATH_INFO'], 10)
+    end = time.time() + seconds
+    while time.time() < end:
+        pass
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    return [b'done']
@@ -0,0 +1,46 @@
+import gc
+
+import whiskey.metrics
+from whiskey import metrics
+
+
+signups = metrics.Counter('test_signups_total', 'Signups.', ['plan'])
+queue = whiskey.metrics.Gauge('test_queue_size', 'Queue size.')
+sizes = metrics.Histogram('test_sizes', 'Sizes.', buckets=[1, 10])
+
+
+def application(environ, start_response):
+    signups.labels(plan='free').inc()
+    signups.labels('pro').inc(2)
+    queue.set(5)
+    queue.dec()
+    sizes.observe(3)
+
+    errors = []
+    try:
+        signups.inc()
+    except ValueError as e:
+        errors.append('ValueError: %s' % e)
+    try:
+        metrics.Counter('test_signups_total', 'Conflict.', ['other'])
+    except RuntimeError as e:
+        errors.append('RuntimeError: %s' % e)
+
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    return [('\n'.join(errors) + '\n').encode('utf-8')]
+
+
+held = []
+
+
+def hold_objects(environ, start_response):
+    # Allocate objects with the garbage collector disabled, so that they're
+    # all counted until the objects are released and it's enabled again.
+    if environ['PATH_INFO'] == '/release':
+        del held[:]
+        gc.enable()
+    else:
+        gc.disable()
+        held.extend([] for _ in range(2000))
+    start_response('200 OK', [('Content-Type', 'text/plain')])
+    return [b'ok\n']
@@ -0,0 +1,123 @@
+package wsgi
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noonat/whiskey/prefork"
+	"github.com/noonat/whiskey/py"
+)
+
+var (
+	// timeoutThreadState is used to interrupt requests that have timed out.
+	// It's only used while holding timeoutMutex, as the thread state can't
+	// be used by two goroutines at once.
+	timeoutMutex       sync.Mutex
+	timeoutThreadState *py.ThreadState
+	pyRequestStack     py.Object
+	pyRequestTimeout   py.Object
+)
+
+// requestTimer interrupts a request's Python code if it runs for too long.
+type requestTimer struct {
+	mutex    sync.Mutex
+	timer    *time.Timer
+	seq      uint64
+	active   bool
+	timedOut bool
+}
+
+// timeoutFor returns the timeout for a request to path. This is the timeout
+// for the longest prefix of path in PathTimeouts, or Timeout if none of them
+// match.
+func (h *Handler) timeoutFor(path string) time.Duration {
+	timeout, longest := h.Timeout, -1
+	for prefix, d := range h.PathTimeouts {
+		if len(prefix) > longest && strings.HasPrefix(path, prefix) {
+			timeout, longest = d, len(prefix)
+		}
+	}
+	return timeout
+}
+
+// startTimer interrupts the request if it's still running after timeout. The
+// request's thread state must be acquired before this is called.
+func (wr *Request) startTimer(timeout time.Duration, logger prefork.Logger) {
+	rt := &wr.timer
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.seq++
+	rt.active = true
+	rt.timedOut = false
+	seq, method, url := rt.seq, wr.req.Method, wr.req.URL.String()
+	rt.timer = time.AfterFunc(timeout, func() {
+		timeoutMutex.Lock()
+		defer timeoutMutex.Unlock()
+		timeoutThreadState.Acquire()
+		defer timeoutThreadState.Release()
+
+		// The request may have finished while this was waiting for the GIL.
+		// It can't finish now, because this is holding the GIL.
+		rt.mutex.Lock()
+		defer rt.mutex.Unlock()
+		if !rt.active || rt.seq != seq {
+			return
+		}
+		if wr.ts.ID() == 0 {
+			logger.Printf("request timed out after %s, but it can't be interrupted "+
+				"with this version of Python: %s %s", timeout, method, url)
+			return
+		}
+		rt.timedOut = true
+		logger.Printf("request timed out after %s: %s %s\n%s", timeout, method, url,
+			requestStack(wr.ts.ID()))
+		wr.ts.Interrupt(pyRequestTimeout)
+	})
+}
+
+// stopTimer stops the request's timer, and reports whether it had already
+// timed out. If it had, any exception that hasn't been raised yet is
+// cancelled, so that it doesn't interrupt the next request. The request's
+// thread state must still be acquired when this is called.
+func (wr *Request) stopTimer() bool {
+	rt := &wr.timer
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if !rt.active {
+		return false
+	}
+	rt.timer.Stop()
+	rt.active = false
+	if rt.timedOut {
+		wr.ts.ClearInterrupt()
+	}
+	return rt.timedOut
+}
+
+// timedOut reports whether the request's timer has expired.
+func (wr *Request) timedOut() bool {
+	wr.timer.mutex.Lock()
+	defer wr.timer.mutex.Unlock()
+	return wr.timer.timedOut
+}
+
+// requestStack returns the Python stack for the thread state with the ID, or
+// an empty string if it isn't running any Python code. The GIL must be held.
+func requestStack(id uint64) string {
+	n, err := py.NewInt(int(id))
+	if err != nil {
+		return ""
+	}
+	defer n.DecRef()
+	o, err := pyRequestStack.Call(n.Object)
+	if err != nil {
+		return ""
+	}
+	defer o.DecRef()
+	s, err := o.GoString()
+	if err != nil {
+		return ""
+	}
+	return s
+}
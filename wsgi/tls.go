@@ -0,0 +1,106 @@
+package wsgi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// These are the values for Worker.ClientCert, which control whether clients
+// are asked for a TLS certificate.
+const (
+	// ClientCertNone doesn't ask clients for a certificate.
+	ClientCertNone = "none"
+
+	// ClientCertOptional asks clients for a certificate, and verifies it
+	// against the CA certificates if they send one.
+	ClientCertOptional = "optional"
+
+	// ClientCertRequired rejects clients that don't send a certificate signed
+	// by one of the CA certificates.
+	ClientCertRequired = "required"
+)
+
+// certLoader loads the TLS certificate and CA certificates from disk. It can
+// reload them without interrupting the server, so that certificates can be
+// renewed without restarting it. Connections that are already open keep
+// using the old certificate.
+type certLoader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+
+	mutex  sync.Mutex
+	config *tls.Config
+}
+
+// newCertLoader creates a certLoader and loads the certificates. If keyFile
+// is empty, the key is read from certFile.
+func newCertLoader(certFile, keyFile, caFile, clientCert string) (*certLoader, error) {
+	cl := &certLoader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if cl.keyFile == "" {
+		cl.keyFile = certFile
+	}
+	switch clientCert {
+	case "", ClientCertNone:
+		cl.clientAuth = tls.NoClientCert
+	case ClientCertOptional:
+		cl.clientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertRequired:
+		cl.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.Errorf("invalid client certificate mode %q", clientCert)
+	}
+	if cl.clientAuth != tls.NoClientCert && caFile == "" {
+		return nil, errors.New("CA certificates are required to verify client certificates")
+	}
+	if err := cl.Reload(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// Reload reads the certificates from disk again. If they can't be loaded,
+// the old ones are kept.
+func (cl *certLoader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "error loading TLS certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   cl.clientAuth,
+		// The handler only speaks HTTP/1.x, so don't offer HTTP/2.
+		NextProtos: []string{"http/1.1"},
+	}
+	if cl.caFile != "" {
+		b, err := ioutil.ReadFile(cl.caFile)
+		if err != nil {
+			return errors.Wrap(err, "error loading CA certificates")
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(b) {
+			return errors.Errorf("no CA certificates found in %s", cl.caFile)
+		}
+	}
+	cl.mutex.Lock()
+	cl.config = config
+	cl.mutex.Unlock()
+	return nil
+}
+
+// TLSConfig returns a config for a TLS listener, which uses the most
+// recently loaded certificates for each new connection.
+func (cl *certLoader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cl.mutex.Lock()
+			defer cl.mutex.Unlock()
+			return cl.config, nil
+		},
+	}
+}
@@ -0,0 +1,201 @@
+package wsgi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key for TLS tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert creates a certificate with the common name, signed by the
+// parent, or self-signed if the parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	return &testCert{cert: cert, key: key, pem: b}
+}
+
+func (tc *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(tc.pem, tc.pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestWorkerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whiskey-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	client := newTestCert(t, "client", ca)
+	certFile := filepath.Join(dir, "server.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(certFile, server.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrk := &Worker{
+		Module:     "apps:tls_info",
+		NumConns:   2,
+		CertFile:   certFile,
+		CACerts:    caFile,
+		ClientCert: ClientCertOptional,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- wrk.Serve(ln, log.New(ioutil.Discard, "", 0))
+	}()
+	defer func() {
+		wrk.Shutdown(context.Background())
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(serverName string, certs ...tls.Certificate) (string, error) {
+		// Each client has its own config, so don't leave connections open
+		// that would use up the worker's connection limit. The certificate
+		// is always sent, even if the server wouldn't accept it.
+		c := &http.Client{Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				RootCAs:    roots,
+				ServerName: serverName,
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					if len(certs) == 0 {
+						return &tls.Certificate{}, nil
+					}
+					return &certs[0], nil
+				},
+			},
+		}}
+		resp, err := c.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	for _, tc := range []struct {
+		certs    []tls.Certificate
+		expected string
+	}{
+		{nil, "https NONE "},
+		{[]tls.Certificate{client.tlsCertificate(t)}, "https SUCCESS CN=client"},
+	} {
+		if body, err := get("server", tc.certs...); err != nil {
+			t.Fatal(err)
+		} else if body != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, body)
+		}
+	}
+
+	// Clients can't use certificates that weren't signed by the CA.
+	other := newTestCert(t, "other", nil)
+	if _, err := get("server", other.tlsCertificate(t)); err == nil {
+		t.Error("expected error for unknown client certificate, got nil")
+	}
+
+	// New connections use the new certificate once it's reloaded.
+	renewed := newTestCert(t, "renewed", ca)
+	if err := ioutil.WriteFile(certFile, renewed.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrk.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get("renewed"); err != nil {
+		t.Errorf("expected renewed certificate, got %v", err)
+	}
+
+	// If the new certificate can't be loaded, the old one is kept.
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrk.Reload(); err == nil {
+		t.Error("expected error reloading invalid certificate, got nil")
+	}
+	if _, err := get("renewed"); err != nil {
+		t.Errorf("expected renewed certificate, got %v", err)
+	}
+}
+
+func TestNewCertLoaderErrors(t *testing.T) {
+	for _, args := range [][4]string{
+		{"testdata/missing.pem", "", "", ClientCertNone},
+		{"testdata/missing.pem", "", "", "sometimes"},
+		{"testdata/missing.pem", "", "", ClientCertRequired},
+	} {
+		if _, err := newCertLoader(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("%q: expected error, got nil", args)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package wsgi
 
 import (
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,14 +12,131 @@ import (
 
 var (
 	pyCreateRequestObjects py.Object
+	pyLoadApplication      py.Object
 	wsgiVersion            py.Tuple
 
 	moduleSource = `
+import ast
+import gc
+import importlib
+import sys
+import traceback
+
 import _whiskey
 
 
 __version__ = '0.1.0'
 
+metrics = sys.modules['whiskey.metrics']
+
+
+def gc_stats():
+    counts = tuple(gc.get_count())
+    if hasattr(gc, 'get_stats'):
+        collections = tuple(s['collections'] for s in gc.get_stats())
+    else:
+        collections = (-1, -1, -1)
+    return counts + collections
+
+
+def heap_size():
+    # Python 2 doesn't count its allocated blocks, so count the objects
+    # tracked by the garbage collector instead.
+    if hasattr(sys, 'getallocatedblocks'):
+        return sys.getallocatedblocks()
+    return len(gc.get_objects())
+
+
+class RequestTimeout(BaseException):
+    # This is raised in requests that run for too long. It's not an
+    # Exception, so that applications that catch Exception don't swallow it.
+    pass
+
+
+def request_stack(thread_id):
+    frame = sys._current_frames().get(thread_id)
+    if frame is None:
+        return ''
+    return ''.join(traceback.format_stack(frame))
+
+
+def load_application(spec):
+    # spec is "module:expression", where expression is a name, a dotted
+    # attribute lookup, or a call to a factory function. Arguments to
+    # factories must be literals, so nothing else in the spec is evaluated.
+    module_name, _, expression = spec.partition(':')
+    expression = expression.strip() or 'application'
+    if not module_name:
+        raise ValueError('no module in application spec %r' % spec)
+    try:
+        node = ast.parse(expression, mode='eval').body
+    except SyntaxError:
+        raise ValueError('%r is not a name or a function call' % expression)
+
+    call = None
+    if isinstance(node, ast.Call):
+        if getattr(node, 'starargs', None) or getattr(node, 'kwargs', None):
+            raise ValueError('%r can only use literal arguments' % expression)
+        try:
+            args = [ast.literal_eval(arg) for arg in node.args]
+            kwargs = {}
+            for keyword in node.keywords:
+                if keyword.arg is None:
+                    raise ValueError()
+                kwargs[keyword.arg] = ast.literal_eval(keyword.value)
+        except ValueError:
+            raise ValueError('%r can only use literal arguments' % expression)
+        call = (args, kwargs)
+        node = node.func
+    names = []
+    while isinstance(node, ast.Attribute):
+        names.insert(0, node.attr)
+        node = node.value
+    if not isinstance(node, ast.Name):
+        raise ValueError('%r is not a name or a function call' % expression)
+    names.insert(0, node.id)
+
+    obj = importlib.import_module(module_name)
+    path = module_name
+    for name in names:
+        try:
+            obj = getattr(obj, name)
+        except AttributeError:
+            raise AttributeError('%s has no attribute %r' % (path, name))
+        path += (':' if path == module_name else '.') + name
+    if call is not None:
+        obj = obj(*call[0], **call[1])
+        if not callable(obj):
+            raise TypeError('%s() returned %r, which is not callable' %
+                            (path, obj))
+    elif not callable(obj):
+        raise TypeError('%s is not callable' % path)
+    return obj
+
+
+def read_config(path):
+    # Config files are Python scripts, like gunicorn's. Any public variable
+    # they define is a setting, with underscores in its name replaced by
+    # dashes. Lists and tuples set the setting once for each item.
+    namespace = {'__file__': path, '__name__': '__config__'}
+    with open(path) as f:
+        code = compile(f.read(), path, 'exec')
+    exec(code, namespace)
+    settings = []
+    for name, value in sorted(namespace.items()):
+        if (name.startswith('_') or callable(value) or
+                isinstance(value, type(sys))):
+            continue
+        name = name.replace('_', '-')
+        values = value if isinstance(value, (list, tuple)) else [value]
+        for value in values:
+            if isinstance(value, bool):
+                value = 'true' if value else 'false'
+            elif value is None:
+                value = ''
+            settings.append((name, str(value)))
+    return settings
+
 
 class ErrorsWriter(object):
 
@@ -46,10 +164,12 @@ class InputReader(object):
 
     def next(self):
         line = _whiskey.call("wsgi_input_read_line", (self._index, None))
-        if line == '':
+        if not line:
             raise StopIteration()
         return line
 
+    __next__ = next
+
     def read(self, size=None):
         return _whiskey.call("wsgi_input_read", (self._index, size))
 
@@ -61,9 +181,14 @@ class InputReader(object):
 
 
 def create_request_objects(index):
+    def write(data):
+        _whiskey.call("wsgi_write", (index, data))
+
     def start_response(status, headers, exc_info=None):
-        return _whiskey.call("wsgi_start_response", (index, status, headers,
-                                                     exc_info))
+        _whiskey.call("wsgi_start_response", (index, status, headers,
+                                              exc_info))
+        return write
+
     return start_response, InputReader(index), ErrorsWriter(index)
 `
 )
@@ -71,6 +196,13 @@ def create_request_objects(index):
 func init() {
 	py.AddInitializer(func() error {
 		registerCallbacks()
+		// The whiskey module exposes this as whiskey.metrics, so it has to
+		// be created first.
+		mm, err := py.NewModuleString("whiskey.metrics", metricsModuleSource)
+		if err != nil {
+			return err
+		}
+		mm.DecRef()
 		m, err := py.NewModuleString("whiskey", moduleSource)
 		if err != nil {
 			return err
@@ -80,32 +212,60 @@ func init() {
 		if err != nil {
 			return err
 		}
+		pyGCStats, err = m.GetAttrString("gc_stats")
+		if err != nil {
+			return err
+		}
+		pyHeapSize, err = m.GetAttrString("heap_size")
+		if err != nil {
+			return err
+		}
+		pyLoadApplication, err = m.GetAttrString("load_application")
+		if err != nil {
+			return err
+		}
+		pyReadConfig, err = m.GetAttrString("read_config")
+		if err != nil {
+			return err
+		}
+		pyRequestStack, err = m.GetAttrString("request_stack")
+		if err != nil {
+			return err
+		}
+		pyRequestTimeout, err = m.GetAttrString("RequestTimeout")
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 	py.AddFinalizer(func() error {
-		if pyCreateRequestObjects.PyObject != nil {
-			pyCreateRequestObjects.DecRef()
-			pyCreateRequestObjects.PyObject = nil
+		for _, o := range []*py.Object{&pyCreateRequestObjects, &pyGCStats, &pyHeapSize,
+			&pyLoadApplication, &pyReadConfig, &pyRequestStack, &pyRequestTimeout} {
+			if o.PyObject != nil {
+				o.DecRef()
+				o.PyObject = nil
+			}
 		}
 		return nil
 	})
 }
 
-func loadApplication(moduleName, applicationName string) (py.Object, error) {
-	m, err := py.ImportModule(moduleName)
+// loadApplication imports and returns the WSGI application named by spec.
+// The spec is the module name, a colon, and then either the application's
+// name within the module, a dotted path to it (e.g. "pkg:obj.wsgi_app"), or a
+// call to a factory function that returns it (e.g.
+// "pkg.app:create_app(config='prod')"). A factory's arguments must be
+// literals. If there's no colon, the application is named "application".
+func loadApplication(spec string) (py.Object, error) {
+	ps, err := py.NewString(spec)
 	if err != nil {
 		return py.Object{}, err
 	}
-	defer m.DecRef()
-
-	application, err := m.GetAttrString(applicationName)
+	defer ps.DecRef()
+	application, err := pyLoadApplication.Call(ps.Object)
 	if err != nil {
-		return py.Object{}, err
-	} else if !application.IsCallable() {
-		application.DecRef()
-		return py.Object{}, errors.New("application is not callable")
+		return py.Object{}, errors.Wrapf(err, "error loading application %q", spec)
 	}
-
 	return application, nil
 }
 
@@ -119,51 +279,75 @@ func loadApplication(moduleName, applicationName string) (py.Object, error) {
 // generating a start_response function per request and binding the WSGIRequest
 // index as the "self" object associated with the function, so we can look it
 // up again later.
-func callApplication(wr *Request) (py.Iter, error) {
+func callApplication(wr *Request) (py.Object, error) {
 	environ, err := createEnviron(wr)
 	if err != nil {
-		return py.Iter{}, err
-	}
-	response, err := wr.application.Call(environ.Object, wr.startResponse)
-	if err != nil {
-		return py.Iter{}, err
+		return py.Object{}, err
 	}
-	return response.Iter()
+	defer environ.DecRef()
+	return wr.application.Call(environ.Object, wr.startResponse)
 }
 
 // writeResponse iterates over the value returned by the WSGI application
 // function, and writes each chunk out to the http.ResponseWriter.
-func writeResponse(wr *Request, iter py.Iter) error {
-	wroteHeaders := false
+func writeResponse(wr *Request, response py.Object) error {
+	iter, err := response.Iter()
+	if err != nil {
+		return err
+	}
+	defer iter.DecRef()
+
+	ctx := wr.req.Context()
 	for {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "client disconnected")
+		}
 		value, err := iter.Next()
 		if err != nil {
 			return err
 		} else if value.PyObject == nil {
 			break
 		}
-		s, err := value.GoString()
-		value.DecRef()
+		pb, err := value.Bytes()
 		if err != nil {
-			return err
+			value.DecRef()
+			return errors.Wrap(err, "response iterable must yield byte strings")
 		}
-
-		b := []byte(s)
+		b := pb.GoBytes()
+		value.DecRef()
 		if len(b) == 0 {
 			continue
 		}
-		if !wroteHeaders {
-			for k, vs := range wr.headers {
-				for _, v := range vs {
-					wr.w.Header().Add(k, v)
-				}
-			}
-			wr.w.WriteHeader(wr.code)
-			wroteHeaders = true
+		if err := wr.write(b); err != nil {
+			return err
 		}
-		wr.w.Write(b)
 	}
 
+	// The application might not have returned any data at all, but we still
+	// need to send the status code and headers it gave us.
+	return wr.writeHeaders()
+}
+
+// closeResponse calls the close() method on the value returned by the WSGI
+// application function, if it has one, and then releases it. This must be
+// called exactly once for every response, whether or not the response was
+// written successfully, so that things like generators get a chance to clean
+// up after themselves.
+func closeResponse(response py.Object) error {
+	defer response.DecRef()
+	if !response.HasAttrString("close") {
+		return nil
+	}
+	fn, err := response.GetAttrString("close")
+	if err != nil {
+		return err
+	}
+	defer fn.DecRef()
+	result, err := fn.Call()
+	if err != nil {
+		return err
+	}
+	result.DecRef()
 	return nil
 }
 
@@ -185,8 +369,8 @@ func convertHeaders(wsgiHeaders py.List) (http.Header, error) {
 		if err != nil {
 			return headers, err
 		}
-		var k, v string
-		if err := ht.GetItems(&k, &v); err != nil {
+		k, v, err := convertHeader(ht)
+		if err != nil {
 			return headers, err
 		}
 		headers.Add(k, v)
@@ -195,6 +379,23 @@ func convertHeaders(wsgiHeaders py.List) (http.Header, error) {
 	return headers, nil
 }
 
+// convertHeader converts a single (name, value) header tuple into Go strings.
+// WSGI requires these to be native strings containing only ISO-8859-1
+// characters, so they're encoded that way on Python 3.
+func convertHeader(ht py.Tuple) (k, v string, err error) {
+	var pk, pv py.String
+	if err = ht.GetItems(&pk, &pv); err != nil {
+		return
+	}
+	defer pk.DecRef()
+	defer pv.DecRef()
+	if k, err = pk.GoStringLatin1(); err != nil {
+		return
+	}
+	v, err = pv.GoStringLatin1()
+	return
+}
+
 // convertStatus converts the WSGI status string into an integer code.
 //
 // WSGI specifies that status must be a string of the form "200 OK". We only
@@ -249,10 +450,12 @@ func sicscs(d py.Dict, k, v string) error {
 	if err != nil {
 		return err
 	}
+	defer pk.DecRef()
 	pv, err := py.CachedString(v)
 	if err != nil {
 		return err
 	}
+	defer pv.DecRef()
 	return d.SetItem(pk.Object, pv.Object)
 }
 
@@ -261,7 +464,8 @@ func sicss(d py.Dict, k, v string) error {
 	if err != nil {
 		return err
 	}
-	return d.SetItemString(pk.Object, v)
+	defer pk.DecRef()
+	return setItemLatin1(d, pk.Object, v)
 }
 
 func sicsi(d py.Dict, k string, v py.Object) error {
@@ -269,9 +473,93 @@ func sicsi(d py.Dict, k string, v py.Object) error {
 	if err != nil {
 		return err
 	}
+	defer pk.DecRef()
 	return d.SetItem(pk.Object, v)
 }
 
+func siss(d py.Dict, k, v string) error {
+	// Header names come from the client, so don't put them in the string
+	// cache, or it could grow without bound.
+	pk, err := py.NewString(k)
+	if err != nil {
+		return err
+	}
+	defer pk.DecRef()
+	return setItemLatin1(d, pk.Object, v)
+}
+
+// setItemLatin1 sets a dict item to a string from the HTTP request. PEP-3333
+// requires these to be native strings, decoded as ISO-8859-1 on Python 3.
+func setItemLatin1(d py.Dict, k py.Object, v string) error {
+	pv, err := py.NewStringLatin1(v)
+	if err != nil {
+		return err
+	}
+	defer pv.DecRef()
+	return d.SetItem(k, pv.Object)
+}
+
+// headerEnvironKey converts an HTTP header name into the key that CGI uses
+// for it in the environ (e.g. "X-Forwarded-For" becomes
+// "HTTP_X_FORWARDED_FOR").
+func headerEnvironKey(k string) string {
+	return "HTTP_" + strings.ToUpper(strings.Replace(k, "-", "_", -1))
+}
+
+// pathInfo returns the part of the request path that comes after the script
+// name. If the path isn't inside the script name, it's returned unchanged.
+func pathInfo(path, scriptName string) string {
+	if scriptName == "" || !strings.HasPrefix(path, scriptName) {
+		return path
+	}
+	rest := path[len(scriptName):]
+	if rest != "" && rest[0] != '/' {
+		return path
+	}
+	return rest
+}
+
+// splitHostPort is like net.SplitHostPort, but it returns the address as the
+// host if it doesn't have a port (e.g. for Unix sockets).
+func splitHostPort(addr string) (host, port string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
+
+// serverNameAndPort returns the values for SERVER_NAME and SERVER_PORT. The
+// name comes from the Host header if the client sent one, and the port comes
+// from the address of the listener that accepted the connection. Either one
+// falls back to the other source if it's missing.
+func serverNameAndPort(req *http.Request) (name, port string) {
+	var hostPort string
+	name, hostPort = splitHostPort(req.Host)
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if ok && strings.HasPrefix(addr.Network(), "tcp") {
+		localName, localPort := splitHostPort(addr.String())
+		if name == "" {
+			name = localName
+		}
+		port = localPort
+	}
+	if port == "" {
+		port = hostPort
+	}
+	if name == "" {
+		name = "localhost"
+	}
+	if port == "" {
+		if req.TLS != nil {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	return name, port
+}
+
 // createEnviron returns a WSGI environ dict for the given request.
 func createEnviron(wr *Request) (py.Dict, error) {
 	// The comments in this function come from the descriptions for keys in
@@ -306,13 +594,13 @@ func createEnviron(wr *Request) (py.Dict, error) {
 	// application object, so that the application knows its virtual
 	// "location". This may be an empty string, if the application corresponds
 	// to the "root" of the server.
-	sicscs(d, "SCRIPT_NAME", "")
+	sicss(d, "SCRIPT_NAME", wr.scriptName)
 
 	// The remainder of the request URL's "path", designating the virtual
 	// "location" of the request's target within the application. This may be
 	// an empty string, if the request URL targets the application root and
 	// does not have a trailing slash.
-	sicss(d, "PATH_INFO", wr.req.URL.Path)
+	sicss(d, "PATH_INFO", pathInfo(wr.req.URL.Path, wr.scriptName))
 
 	// The portion of the request URL that follows the "?", if any. May be
 	// empty or absent.
@@ -331,8 +619,57 @@ func createEnviron(wr *Request) (py.Dict, error) {
 	// should be used in preference to SERVER_NAME for reconstructing the
 	// request URL. SERVER_NAME and SERVER_PORT can never be empty strings, and
 	// so are always required.
-	sicss(d, "SERVER_NAME", "127.0.0.1")
-	sicss(d, "SERVER_PORT", "8080")
+	serverName, serverPort := serverNameAndPort(wr.req)
+	sicss(d, "SERVER_NAME", serverName)
+	sicss(d, "SERVER_PORT", serverPort)
+
+	// The address of the client that sent the request. These aren't part of
+	// PEP-3333, but they're part of CGI, and applications expect to find them.
+	remoteAddr, remotePort := splitHostPort(wr.req.RemoteAddr)
+	sicss(d, "REMOTE_ADDR", remoteAddr)
+	if remotePort != "" {
+		sicss(d, "REMOTE_PORT", remotePort)
+	}
+
+	// Details about the TLS connection, using the names from Apache's
+	// mod_ssl. The client certificate's subject and issuer are only set if
+	// the client sent one and it was verified.
+	if wr.req.TLS != nil {
+		sicscs(d, "HTTPS", "on")
+		if chains := wr.req.TLS.VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+			cert := chains[0][0]
+			sicscs(d, "SSL_CLIENT_VERIFY", "SUCCESS")
+			sicss(d, "SSL_CLIENT_S_DN", cert.Subject.String())
+			sicss(d, "SSL_CLIENT_I_DN", cert.Issuer.String())
+		} else {
+			sicscs(d, "SSL_CLIENT_VERIFY", "NONE")
+		}
+	}
+
+	// Variables corresponding to the client-supplied HTTP request headers
+	// (i.e., variables whose names begin with "HTTP_"). The presence or
+	// absence of these variables should correspond with the presence or
+	// absence of the appropriate HTTP header in the request.
+	if wr.req.Host != "" {
+		sicss(d, "HTTP_HOST", wr.req.Host)
+	}
+	for k, vs := range wr.req.Header {
+		if k == "Content-Type" || k == "Content-Length" {
+			continue
+		} else if strings.Contains(k, "_") {
+			// X_Forwarded_For would have the same key as X-Forwarded-For,
+			// and could be used to spoof it, so drop headers with
+			// underscores like gunicorn and nginx do.
+			continue
+		}
+		sep := ","
+		if k == "Cookie" {
+			// Cookies are the one header that can't be combined with commas,
+			// as the values can contain them.
+			sep = "; "
+		}
+		siss(d, headerEnvironKey(k), strings.Join(vs, sep))
+	}
 
 	// The version of the protocol the client used to send the request.
 	// Typically this will be something like "HTTP/1.0" or "HTTP/1.1" and may
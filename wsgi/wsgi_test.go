@@ -0,0 +1,346 @@
+package wsgi
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/noonat/whiskey/py"
+)
+
+func init() {
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("PYTHONPATH", filepath.Join(wd, "testdata"))
+	if err := initialize(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newTestRequest(t *testing.T, w http.ResponseWriter, req *http.Request) *Request {
+	wr, err := newRequest(py.None, mainThreadState.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr.Reset(w, req)
+	return wr
+}
+
+func runTestApp(t *testing.T, name string, w http.ResponseWriter, req *http.Request) error {
+	wr := newTestRequest(t, w, req)
+	wr.ts.Acquire()
+	defer wr.ts.Release()
+
+	application, err := loadApplication("apps:" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer application.DecRef()
+	wr.application = application
+
+	response, err := callApplication(wr)
+	if err == nil {
+		err = writeResponse(wr, response)
+		if closeErr := closeResponse(response); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func serveTestApp(t *testing.T, name string, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	if err := runTestApp(t, name, w, req); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// disconnectingWriter cancels the request context after the first write, as
+// if the client had gone away.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	cancel func()
+}
+
+func (w *disconnectingWriter) Write(b []byte) (int, error) {
+	defer w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+// closedPaths returns the paths that were appended to apps.closed when
+// response iterables were closed.
+func closedPaths(t *testing.T) []string {
+	mainThreadState.Acquire()
+	defer mainThreadState.Release()
+	m, err := py.ImportModule("apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.DecRef()
+	o, err := m.GetAttrString("closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.DecRef()
+	l, err := o.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for i := 0; i < l.Len(); i++ {
+		v, err := l.GetItem(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := v.GoString()
+		v.DecRef()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, s)
+	}
+	return paths
+}
+
+// expectClosed checks that the response for the path was closed exactly once,
+// ignoring any responses that were closed before the start index.
+func expectClosed(t *testing.T, start int, path string) {
+	n := 0
+	for _, p := range closedPaths(t)[start:] {
+		if p == path {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected response for %s to be closed once, closed %d times", path, n)
+	}
+}
+
+func environString(t *testing.T, d py.Dict, k string) (string, bool) {
+	pk, err := py.NewString(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pk.DecRef()
+	v, err := d.GetItem(pk.Object)
+	if err != nil {
+		t.Fatal(err)
+	} else if v.PyObject == nil {
+		return "", false
+	}
+	defer v.DecRef()
+	s, err := v.GoString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, true
+}
+
+func TestCreateEnviron(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/app/foo?a=1", nil)
+	req.RemoteAddr = "10.0.0.1:54321"
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+	req.Header.Add("X-Forwarded-For", "10.0.0.3")
+	req.Header["X_Forwarded_For"] = []string{"6.6.6.6"}
+	req.Header.Add("Cookie", "a=1")
+	req.Header.Add("Cookie", "b=2")
+	localAddr := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 8000}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, localAddr))
+
+	wr := newTestRequest(t, httptest.NewRecorder(), req)
+	wr.scriptName = "/app"
+	wr.ts.Acquire()
+	defer wr.ts.Release()
+	d, err := createEnviron(wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DecRef()
+
+	for k, expected := range map[string]string{
+		"REQUEST_METHOD":       "POST",
+		"SCRIPT_NAME":          "/app",
+		"PATH_INFO":            "/foo",
+		"QUERY_STRING":         "a=1",
+		"CONTENT_TYPE":         "text/plain",
+		"SERVER_NAME":          "example.com",
+		"SERVER_PORT":          "8000",
+		"REMOTE_ADDR":          "10.0.0.1",
+		"REMOTE_PORT":          "54321",
+		"HTTP_HOST":            "example.com",
+		"HTTP_X_FORWARDED_FOR": "10.0.0.2,10.0.0.3",
+		"HTTP_COOKIE":          "a=1; b=2",
+	} {
+		if v, ok := environString(t, d, k); !ok {
+			t.Errorf("expected %s to be set", k)
+		} else if v != expected {
+			t.Errorf("expected %s to be %q, got %q", k, expected, v)
+		}
+	}
+	if _, ok := environString(t, d, "HTTP_CONTENT_TYPE"); ok {
+		t.Error("expected HTTP_CONTENT_TYPE to be absent")
+	}
+}
+
+func TestLoadApplication(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"apps:hello":              "hello world",
+		"apps:container.wsgi_app": "hello world",
+		"apps:create_app()":       "hello world",
+		"apps:create_app('hi')":   "hi world",
+		"apps:create_app(greeting='hey', name=\"you\")": "hey you",
+	} {
+		h, err := NewHandler(spec, 1)
+		if err != nil {
+			t.Errorf("%s: %+v", spec, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		h.Close()
+		if body := w.Body.String(); body != expected {
+			t.Errorf("%s: expected %q, got %q", spec, expected, body)
+		}
+	}
+
+	for spec, expected := range map[string]string{
+		"apps":                        "has no attribute 'application'",
+		":hello":                      "no module",
+		"no_such_module:app":          "No module named",
+		"apps:nope":                   "apps has no attribute 'nope'",
+		"apps:container.nope":         "apps:container has no attribute 'nope'",
+		"apps:not_callable":           "apps:not_callable is not callable",
+		"apps:create_app(sys.argv)":   "can only use literal arguments",
+		"apps:create_app(**{})":       "can only use literal arguments",
+		"apps:Container()":            "which is not callable",
+		"apps:hello[0]":               "is not a name or a function call",
+		"apps:import os":              "is not a name or a function call",
+		"apps:create_app().__class__": "is not a name or a function call",
+	} {
+		mainThreadState.Acquire()
+		application, err := loadApplication(spec)
+		if err == nil {
+			application.DecRef()
+		}
+		mainThreadState.Release()
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", spec)
+		} else if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q, got %q", spec, expected, err)
+		}
+	}
+}
+
+func TestPathInfo(t *testing.T) {
+	for _, tc := range []struct {
+		path, scriptName, expected string
+	}{
+		{"/foo", "", "/foo"},
+		{"/app", "/app", ""},
+		{"/app/foo", "/app", "/foo"},
+		{"/application", "/app", "/application"},
+		{"/other", "/app", "/other"},
+	} {
+		if v := pathInfo(tc.path, tc.scriptName); v != tc.expected {
+			t.Errorf("pathInfo(%q, %q): expected %q, got %q", tc.path, tc.scriptName, tc.expected, v)
+		}
+	}
+}
+
+func TestInputRead(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("hello world"))
+	w := serveTestApp(t, "echo", req)
+	if body := w.Body.String(); body != "hello world" {
+		t.Errorf(`expected "hello world", got %q`, body)
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	w := serveTestApp(t, "hello", httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf(`expected "text/plain", got %q`, ct)
+	}
+	if body := w.Body.String(); body != "hello world" {
+		t.Errorf(`expected "hello world", got %q`, body)
+	}
+}
+
+func TestWriteCallable(t *testing.T) {
+	w := serveTestApp(t, "legacy_write", httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "hello world" {
+		t.Errorf(`expected "hello world", got %q`, body)
+	}
+}
+
+func TestStartResponseTwice(t *testing.T) {
+	w := serveTestApp(t, "start_response_twice", httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "raised" {
+		t.Errorf(`expected "raised", got %q`, body)
+	}
+}
+
+func TestStartResponseExcInfo(t *testing.T) {
+	w := serveTestApp(t, "error_before_headers", httptest.NewRequest("GET", "/", nil))
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html" {
+		t.Errorf(`expected "text/html", got %q`, ct)
+	}
+
+	w = serveTestApp(t, "error_after_headers", httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "partial raised" {
+		t.Errorf(`expected "partial raised", got %q`, body)
+	}
+}
+
+func TestCloseResponse(t *testing.T) {
+	start := len(closedPaths(t))
+	w := serveTestApp(t, "generator", httptest.NewRequest("GET", "/normal", nil))
+	if body := w.Body.String(); body != "hello world" {
+		t.Errorf(`expected "hello world", got %q`, body)
+	}
+	expectClosed(t, start, "/normal")
+
+	// A Python error while iterating over the response.
+	err := runTestApp(t, "bad_chunk", httptest.NewRecorder(), httptest.NewRequest("GET", "/error", nil))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+	expectClosed(t, start, "/error")
+
+	// The client disconnecting before the response is finished.
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/disconnect", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	err = runTestApp(t, "generator", &disconnectingWriter{w, cancel}, req)
+	if body := w.Body.String(); body != "hello" {
+		t.Errorf(`expected "hello", got %q`, body)
+	}
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+	expectClosed(t, start, "/disconnect")
+}